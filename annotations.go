@@ -74,4 +74,36 @@ const (
 	// AnnotationVaultMultiSecretPrefix allow multi secret by order
 	// vault.secret.manager/secret-config-1: '{"Path": "secrets/v2/plain/secrets/path/app", "Version": "2", "use-secret-names-as-keys": "true"}'
 	AnnotationVaultMultiSecretPrefix = "vault.secret.manager/secret-config-"
+
+	// AnnotationContainerScope prefixes the name of a container after any secret manager annotation prefix to
+	// override the setting for that container only, e.g. vault.secret.manager/container.migrate.path
+	AnnotationContainerScope = "container."
+
+	// AnnotationSchemaVersion the version of the annotations schema the pod annotations are validated against, defaults to v1
+	AnnotationSchemaVersion = "secrets-consumer/schema-version"
+
+	// AnnotationImageConfigs the container entrypoints resolved by the webhook on the pod template
+	// of a workload, as a JSON object keyed by container name. Set by the webhook, not by users
+	AnnotationImageConfigs = "secrets-consumer/image-configs"
+
+	// AnnotationCommand the command of the containers that don't set one, skips the image metadata lookup.
+	// Either a JSON array for every container, e.g. '["/app", "serve"]', or an object keyed by container name
+	AnnotationCommand = "secrets-consumer/command"
+
+	// AnnotationContainers comma separated names of the only init containers and containers to inject secrets into
+	AnnotationContainers = "secrets-consumer/containers"
+
+	// AnnotationExcludeContainers comma separated names of init containers and containers to leave untouched
+	AnnotationExcludeContainers = "secrets-consumer/exclude-containers"
+
+	// AnnotationExplicitSecrets only expose the secret manager keys referenced by vault: or secret: env values,
+	// the containers referencing none are not injected
+	AnnotationExplicitSecrets = "secrets-consumer/explicit-secrets"
+
+	// AnnotationWarning set by the webhook on pods admitted with containers whose command it could not detect
+	AnnotationWarning = "secrets-consumer/warning"
+
+	// AnnotationStatus set by the webhook on the pods it mutated, a JSON object with the webhook version,
+	// the secret manager backends and the init containers and containers running with the wrapper
+	AnnotationStatus = "secrets-consumer/status"
 )
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// auditSchemaVersion is bumped on any change of the audit records that is not a new optional field
+const auditSchemaVersion = "v1"
+
+// auditRecord is the audit log entry of a pod admission. It describes where the secrets of the
+// pod are read from and with which identity, never the secret values nor the env of the pod
+type auditRecord struct {
+	SchemaVersion string              `json:"schemaVersion"`
+	Time          time.Time           `json:"time"`
+	AdmissionUID  string              `json:"admissionUID"`
+	Operation     string              `json:"operation"`
+	DryRun        bool                `json:"dryRun"`
+	Decision      string              `json:"decision"`
+	Reason        string              `json:"reason,omitempty"`
+	Error         string              `json:"error,omitempty"`
+	User          auditUser           `json:"user"`
+	Pod           auditPod            `json:"pod"`
+	Secrets       []auditSecretSource `json:"secrets"`
+}
+
+// auditUser is the user that created the pod, from the admission request
+type auditUser struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type auditPod struct {
+	Namespace      string      `json:"namespace"`
+	Name           string      `json:"name,omitempty"`
+	GenerateName   string      `json:"generateName,omitempty"`
+	ServiceAccount string      `json:"serviceAccount"`
+	Owner          *auditOwner `json:"owner,omitempty"`
+	// InitContainers and Containers run with the wrapper, on mutated pods only
+	InitContainers []string `json:"initContainers,omitempty"`
+	Containers     []string `json:"containers,omitempty"`
+}
+
+type auditOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// auditSecretSource is a secret manager location a pod is configured to read, with the
+// identity it reads it with. Container is set for the container scoped annotations
+type auditSecretSource struct {
+	Backend   string `json:"backend"`
+	Container string `json:"container,omitempty"`
+
+	// vault
+	Address  string `json:"address,omitempty"`
+	AuthPath string `json:"authPath,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Path     string `json:"path,omitempty"`
+
+	// aws and gcp
+	Region                  string `json:"region,omitempty"`
+	ProjectID               string `json:"projectID,omitempty"`
+	SecretName              string `json:"secretName,omitempty"`
+	RoleARN                 string `json:"roleARN,omitempty"`
+	ServiceAccountKeySecret string `json:"serviceAccountKeySecret,omitempty"`
+
+	Version string `json:"version,omitempty"`
+}
+
+// auditSecretSources lists the enabled backends of the pod and of its containers
+func auditSecretSources(smCfg secretManagerConfig) []auditSecretSource {
+	sources := append([]auditSecretSource{}, backendSecretSources(smCfg, "")...)
+
+	names := make([]string, 0, len(smCfg.containerConfigs))
+	for name := range smCfg.containerConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sources = append(sources, backendSecretSources(smCfg.containerConfigs[name], name)...)
+	}
+	return sources
+}
+
+func backendSecretSources(cfg secretManagerConfig, container string) []auditSecretSource {
+	var sources []auditSecretSource
+	if c := cfg.aws.config; c.enabled {
+		version := ""
+		if c.previousVersion == "true" {
+			version = "previous"
+		}
+		sources = append(sources, auditSecretSource{
+			Backend: "aws", Container: container, Region: c.region, SecretName: c.secretName, RoleARN: c.roleARN, Version: version,
+		})
+	}
+	if c := cfg.gcp.config; c.enabled {
+		sources = append(sources, auditSecretSource{
+			Backend: "gcp", Container: container, ProjectID: c.projectID, SecretName: c.secretName, Version: c.secretVersion,
+			ServiceAccountKeySecret: c.serviceAccountKeySecretName,
+		})
+	}
+	if c := cfg.vault.config; c.enabled {
+		vault := auditSecretSource{
+			Backend: "vault", Container: container, Address: c.addr, AuthPath: c.backend, Role: c.role,
+			ServiceAccountKeySecret: c.gcpServiceAccountKeySecretName,
+		}
+		// the secret configs replace the path annotation
+		if len(c.secretConfigs) == 0 {
+			vault.Path, vault.Version = c.path, c.version
+			sources = append(sources, vault)
+		}
+		for _, canonical := range c.secretConfigs {
+			var secretConfig vaultSecretConfig
+			if err := json.Unmarshal([]byte(canonical), &secretConfig); err != nil {
+				continue
+			}
+			vault.Path, vault.Version = secretConfig.Path, secretConfig.Version
+			sources = append(sources, vault)
+		}
+	}
+	return sources
+}
+
+// newAuditRecord describes the admission of a pod, decision is mutated or denied
+func newAuditRecord(ctx context.Context, pod *corev1.Pod, smCfg secretManagerConfig, decision, reason string, err error) auditRecord {
+	record := auditRecord{
+		SchemaVersion: auditSchemaVersion,
+		Time:          time.Now().UTC(),
+		Decision:      decision,
+		Reason:        reason,
+		Pod: auditPod{
+			Namespace:      pod.Namespace,
+			Name:           pod.Name,
+			GenerateName:   pod.GenerateName,
+			ServiceAccount: pod.Spec.ServiceAccountName,
+		},
+		Secrets: auditSecretSources(smCfg),
+	}
+	if record.Pod.ServiceAccount == "" {
+		record.Pod.ServiceAccount = "default"
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		record.Pod.Owner = &auditOwner{Kind: owner.Kind, Name: owner.Name}
+	}
+	if decision == "mutated" {
+		status := newInjectionStatus(pod, smCfg)
+		record.Pod.InitContainers, record.Pod.Containers = status.InitContainers, status.Containers
+	}
+
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		record.AdmissionUID = string(ar.UID)
+		record.Operation = string(ar.Operation)
+		record.DryRun = whcontext.IsAdmissionRequestDryRun(ctx)
+		record.User = auditUser{Username: ar.UserInfo.Username, UID: ar.UserInfo.UID, Groups: ar.UserInfo.Groups}
+		if ar.Namespace != "" {
+			record.Pod.Namespace = ar.Namespace
+		}
+	}
+	return record
+}
+
+// auditSink is a destination of the audit records, written as JSON lines. close flushes the
+// records, waiting for them until ctx is done, no record is written after it
+type auditSink interface {
+	name() string
+	write(line []byte) error
+	close(ctx context.Context) error
+}
+
+// auditor writes the audit records to every sink of audit_sinks
+type auditor struct {
+	sinks  []auditSink
+	logger log.FieldLogger
+}
+
+func newAuditor(logger log.FieldLogger) (*auditor, error) {
+	a := &auditor{logger: logger}
+	for _, name := range parseContainerNames(viper.GetString("audit_sinks")) {
+		switch name {
+		case "stdout":
+			a.sinks = append(a.sinks, &writerSink{w: os.Stdout})
+		case "file":
+			sink, err := newFileSink(viper.GetString("audit_file_path"), viper.GetInt64("audit_file_max_size"), viper.GetInt("audit_file_max_backups"))
+			if err != nil {
+				return nil, err
+			}
+			a.sinks = append(a.sinks, sink)
+		case "http":
+			sink, err := newHTTPSink(viper.GetString("audit_http_url"), logger)
+			if err != nil {
+				return nil, err
+			}
+			a.sinks = append(a.sinks, sink)
+		default:
+			return nil, fmt.Errorf("unknown audit sink %q, expected stdout, file or http", name)
+		}
+	}
+	return a, nil
+}
+
+func (a *auditor) record(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		a.logger.Errorf("cannot encode the audit record of admission %s: %s", record.AdmissionUID, err)
+		return
+	}
+	line = append(line, '\n')
+
+	for _, sink := range a.sinks {
+		if err := sink.write(line); err != nil {
+			a.logger.Errorf("cannot write the audit record of admission %s to %s: %s", record.AdmissionUID, sink.name(), err)
+		}
+	}
+}
+
+// close flushes and closes every sink, it is called once the admissions are drained
+func (a *auditor) close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range a.sinks {
+		if err := sink.close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("cannot close the %s audit sink: %s", sink.name(), err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// countAuditRecord counts a record written by a sink, or that it failed to write
+func countAuditRecord(sink string, err error) error {
+	if err != nil {
+		auditRecords.WithLabelValues(sink, "error").Inc()
+	} else {
+		auditRecords.WithLabelValues(sink, "written").Inc()
+	}
+	return err
+}
+
+// writerSink writes the records to stdout
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) name() string { return "stdout" }
+
+func (s *writerSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(line)
+	return countAuditRecord(s.name(), err)
+}
+
+func (s *writerSink) close(context.Context) error { return nil }
+
+// fileSink writes the records to a file, renamed to path.1 once larger than maxSize. The older
+// files are shifted up to path.<maxBackups> and the oldest one is removed
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("audit_file_path is required by the file audit sink")
+	}
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) name() string { return "file" }
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open the audit file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open the audit file: %s", err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return countAuditRecord(s.name(), fmt.Errorf("the audit file is closed"))
+	}
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return countAuditRecord(s.name(), err)
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return countAuditRecord(s.name(), err)
+}
+
+func (s *fileSink) close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("cannot rotate the audit file: %s", err)
+	}
+
+	if s.maxBackups < 1 {
+		if err := os.Remove(s.path); err != nil {
+			return fmt.Errorf("cannot rotate the audit file: %s", err)
+		}
+		return s.open()
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rotate the audit file: %s", err)
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return fmt.Errorf("cannot rotate the audit file: %s", err)
+	}
+	return s.open()
+}
+
+// httpSink posts every record to audit_http_url in the background, so that a slow audit
+// endpoint does not slow down the admissions. The records are dropped when audit_http_queue_size
+// of them are waiting. close sends the waiting records before the webhook exits
+type httpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	queue   chan []byte
+	done    chan struct{}
+	logger  log.FieldLogger
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newHTTPSink(url string, logger log.FieldLogger) (*httpSink, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid audit_http_url %q, it must start with http:// or https://", url)
+	}
+
+	headers := map[string]string{}
+	for _, header := range parseContainerNames(viper.GetString("audit_http_headers")) {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid audit HTTP header %q, expected name=value", header)
+		}
+		headers[parts[0]] = parts[1]
+	}
+
+	s := &httpSink{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: viper.GetDuration("audit_http_timeout")},
+		queue:   make(chan []byte, viper.GetInt("audit_http_queue_size")),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *httpSink) name() string { return "http" }
+
+func (s *httpSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		auditRecords.WithLabelValues(s.name(), "dropped").Inc()
+		return fmt.Errorf("the sink is closed, dropping the record")
+	}
+
+	select {
+	case s.queue <- line:
+		return nil
+	default:
+		auditRecords.WithLabelValues(s.name(), "dropped").Inc()
+		return fmt.Errorf("%d records are waiting to be sent, dropping the record", cap(s.queue))
+	}
+}
+
+func (s *httpSink) run() {
+	defer close(s.done)
+	for line := range s.queue {
+		if err := countAuditRecord(s.name(), s.post(line)); err != nil {
+			s.logger.Errorf("cannot send an audit record: %s", err)
+		}
+	}
+}
+
+// close stops accepting records and waits for run to send the waiting ones, until ctx is done
+func (s *httpSink) close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d records were not sent: %s", len(s.queue), ctx.Err())
+	}
+}
+
+func (s *httpSink) post(line []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
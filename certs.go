@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// keys of the self-managed TLS Secret, ca.crt holds the current CA first, followed by the
+// previous CA while it is still valid so that the certificates it signed keep working
+const (
+	tlsSecretCACert = "ca.crt"
+	tlsSecretCAKey  = "ca.key"
+	tlsSecretCert   = corev1.TLSCertKey
+	tlsSecretKey    = corev1.TLSPrivateKeyKey
+)
+
+// certManager keeps a CA and a serving certificate in a Secret, rotates them before they
+// expire and keeps the caBundle of the webhook configurations in sync. The serving
+// certificate is reloaded by GetCertificate, so rotations do not need a restart
+type certManager struct {
+	client           kubernetes.Interface
+	namespace        string
+	secretName       string
+	dnsNames         []string
+	mutatingConfig   string
+	validatingConfig string
+	caValidity       time.Duration
+	certValidity     time.Duration
+	rotateBefore     time.Duration
+	logger           log.FieldLogger
+	now              func() time.Time
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertManager(client kubernetes.Interface, logger log.FieldLogger) (*certManager, error) {
+	m := &certManager{
+		client:           client,
+		namespace:        viper.GetString("tls_namespace"),
+		secretName:       viper.GetString("tls_secret_name"),
+		mutatingConfig:   viper.GetString("tls_mutating_webhook_configuration"),
+		validatingConfig: viper.GetString("tls_validating_webhook_configuration"),
+		caValidity:       viper.GetDuration("tls_ca_validity"),
+		certValidity:     viper.GetDuration("tls_cert_validity"),
+		rotateBefore:     viper.GetDuration("tls_rotate_before"),
+		logger:           logger,
+		now:              time.Now,
+	}
+
+	service := viper.GetString("tls_service_name")
+	switch {
+	case m.namespace == "" || m.secretName == "" || service == "" || m.mutatingConfig == "":
+		return nil, fmt.Errorf("self-managed TLS needs tls_namespace, tls_secret_name, tls_service_name and tls_mutating_webhook_configuration")
+	case m.rotateBefore >= m.certValidity || m.rotateBefore >= m.caValidity:
+		return nil, fmt.Errorf("tls_rotate_before (%s) must be shorter than tls_cert_validity (%s) and tls_ca_validity (%s)", m.rotateBefore, m.certValidity, m.caValidity)
+	}
+
+	m.dnsNames = []string{
+		service,
+		fmt.Sprintf("%s.%s", service, m.namespace),
+		fmt.Sprintf("%s.%s.svc", service, m.namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, m.namespace),
+	}
+	return m, nil
+}
+
+// GetCertificate returns the current serving certificate, see tls.Config
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, fmt.Errorf("the serving certificate is not loaded yet")
+	}
+	return m.cert, nil
+}
+
+// run checks the certificates every tls_check_interval until stopCh is closed
+func (m *certManager) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(viper.GetDuration("tls_check_interval"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := m.ensure(); err != nil {
+				m.logger.Errorf("Cannot renew the webhook certificates: %s", err)
+			}
+		}
+	}
+}
+
+// ensure loads the certificates from the Secret, creating or rotating them when needed,
+// and patches the caBundle of the webhook configurations. Replicas racing to rotate the
+// certificates settle on the one written first. The caBundle, which holds the new and the
+// previous CA, is patched before the serving certificate is switched, so that the API
+// server trusts the new certificate before it is served and the old one until it expires
+func (m *certManager) ensure() error {
+	var caBundle []byte
+	var cert *tls.Certificate
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		caBundle, cert, err = m.sync()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.patchCABundle(caBundle); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	return nil
+}
+
+// sync reads the Secret, rotates the certificates if needed and returns the CA bundle and the serving certificate
+func (m *certManager) sync() ([]byte, *tls.Certificate, error) {
+	secret, err := m.client.CoreV1().Secrets(m.namespace).Get(m.secretName, metav1.GetOptions{})
+	exists := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, nil, fmt.Errorf("cannot read the TLS secret %s: %s", m.secretName, err)
+	}
+	if !exists {
+		secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: m.secretName, Namespace: m.namespace}}
+	}
+
+	data, rotated, err := m.rotate(secret.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rotated {
+		secret.Data = data
+		if exists {
+			_, err = m.client.CoreV1().Secrets(m.namespace).Update(secret)
+		} else {
+			_, err = m.client.CoreV1().Secrets(m.namespace).Create(secret)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(data[tlsSecretCert], data[tlsSecretKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid serving certificate in the TLS secret %s: %s", m.secretName, err)
+	}
+	return data[tlsSecretCACert], &cert, nil
+}
+
+// rotate returns the Secret data with a new CA, when it is missing or expires within rotateBefore,
+// and a new serving certificate, when it is missing, expires within rotateBefore, was not signed
+// by the current CA or does not cover the service names
+func (m *certManager) rotate(data map[string][]byte) (map[string][]byte, bool, error) {
+	now := m.now()
+	expiring := func(cert *x509.Certificate) bool {
+		return now.Add(m.rotateBefore).After(cert.NotAfter)
+	}
+
+	cas := parseCertificates(data[tlsSecretCACert])
+	caKey, _ := parsePrivateKey(data[tlsSecretCAKey])
+
+	rotated := false
+	var ca *x509.Certificate
+	if len(cas) > 0 && caKey != nil && publicKeysEqual(cas[0].PublicKey, caKey.Public()) && !expiring(cas[0]) {
+		ca = cas[0]
+	} else {
+		var err error
+		if ca, caKey, err = m.newCA(now); err != nil {
+			return nil, false, fmt.Errorf("cannot create the webhook CA: %s", err)
+		}
+		m.logger.Infof("Created a new webhook CA valid until %s", ca.NotAfter.Format(time.RFC3339))
+		// the previous CA stays in the bundle until it expires
+		cas = append([]*x509.Certificate{ca}, cas...)
+		rotated = true
+	}
+
+	var bundle []*x509.Certificate
+	for _, c := range cas {
+		if now.Before(c.NotAfter) {
+			bundle = append(bundle, c)
+		}
+	}
+	if len(bundle) != len(cas) {
+		rotated = true
+	}
+
+	certPEM, keyPEM := data[tlsSecretCert], data[tlsSecretKey]
+	if m.needsServingCert(certPEM, keyPEM, ca, expiring) {
+		var err error
+		if certPEM, keyPEM, err = m.newServingCert(now, ca, caKey); err != nil {
+			return nil, false, fmt.Errorf("cannot create the webhook serving certificate: %s", err)
+		}
+		m.logger.Infof("Created a new webhook serving certificate valid until %s", now.Add(m.certValidity).Format(time.RFC3339))
+		rotated = true
+	}
+
+	if !rotated {
+		return data, false, nil
+	}
+
+	caKeyPEM, err := encodePrivateKey(caKey)
+	if err != nil {
+		return nil, false, err
+	}
+	var caBundle bytes.Buffer
+	for _, c := range bundle {
+		_ = pem.Encode(&caBundle, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return map[string][]byte{
+		tlsSecretCACert: caBundle.Bytes(),
+		tlsSecretCAKey:  caKeyPEM,
+		tlsSecretCert:   certPEM,
+		tlsSecretKey:    keyPEM,
+	}, true, nil
+}
+
+func (m *certManager) needsServingCert(certPEM, keyPEM []byte, ca *x509.Certificate, expiring func(*x509.Certificate) bool) bool {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || expiring(leaf) || leaf.CheckSignatureFrom(ca) != nil {
+		return true
+	}
+	for _, name := range m.dnsNames {
+		if leaf.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *certManager) newCA(now time.Time) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("secrets-consumer-webhook-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(m.caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func (m *certManager) newServingCert(now time.Time, ca *x509.Certificate, caKey crypto.Signer) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: m.dnsNames[2]},
+		DNSNames:     m.dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(m.certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// patchCABundle sets the caBundle of every webhook of the webhook configurations. The
+// validating configuration is optional as workload validation may be disabled
+func (m *certManager) patchCABundle(caBundle []byte) error {
+	mutating := m.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := mutating.Get(m.mutatingConfig, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		m.logger.Infof("Updating the caBundle of the MutatingWebhookConfiguration %s", m.mutatingConfig)
+		_, err = mutating.Update(config)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot patch the caBundle of the MutatingWebhookConfiguration %s: %s", m.mutatingConfig, err)
+	}
+
+	if m.validatingConfig == "" {
+		return nil
+	}
+	validating := m.client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := validating.Get(m.validatingConfig, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		m.logger.Infof("Updating the caBundle of the ValidatingWebhookConfiguration %s", m.validatingConfig)
+		_, err = validating.Update(config)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot patch the caBundle of the ValidatingWebhookConfiguration %s: %s", m.validatingConfig, err)
+	}
+	return nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && block.Type == "CERTIFICATE" {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	derA, errA := x509.MarshalPKIXPublicKey(a)
+	derB, errB := x509.MarshalPKIXPublicKey(b)
+	return errA == nil && errB == nil && bytes.Equal(derA, derB)
+}
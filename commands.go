@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// imageConfigFailurePolicyReject denies the pod when the command of a container cannot be detected
+	imageConfigFailurePolicyReject = "reject"
+
+	// imageConfigFailurePolicyAdmitWithWarning admits the pod with the containers whose command
+	// cannot be detected still wrapped, the wrapper resolves the entrypoint of their image when they
+	// start. Why is recorded in the AnnotationWarning annotation and in a Warning Event per container
+	imageConfigFailurePolicyAdmitWithWarning = "admit-with-warning"
+)
+
+// validateImageConfigFailurePolicy checks image_config_failure_policy at startup, a typo would
+// otherwise reject every pod whose command cannot be detected
+func validateImageConfigFailurePolicy(policy string) error {
+	switch policy {
+	case imageConfigFailurePolicyReject, imageConfigFailurePolicyAdmitWithWarning:
+		return nil
+	default:
+		return fmt.Errorf("invalid image_config_failure_policy %q, use %q or %q", policy, imageConfigFailurePolicyReject, imageConfigFailurePolicyAdmitWithWarning)
+	}
+}
+
+// commandHint returns the command supplied with the AnnotationCommand annotation for a container
+func commandHint(smCfg secretManagerConfig, container corev1.Container) []string {
+	if command, ok := smCfg.commandHints[container.Name]; ok {
+		return command
+	}
+	return smCfg.commandHint
+}
+
+// parseCommandHints parses the AnnotationCommand annotation, either a JSON array used for every
+// container or a JSON object of arrays keyed by container name
+func parseCommandHints(value string) ([]string, map[string][]string, error) {
+	if value == "" {
+		return nil, nil, nil
+	}
+
+	var command []string
+	if err := json.Unmarshal([]byte(value), &command); err == nil {
+		if len(command) == 0 {
+			return nil, nil, fmt.Errorf("the command is empty")
+		}
+		return command, nil, nil
+	}
+
+	var commands map[string][]string
+	if err := json.Unmarshal([]byte(value), &commands); err != nil {
+		return nil, nil, fmt.Errorf(`expected a JSON array like ["/app", "serve"] or an object of arrays keyed by container name: %s`, err)
+	}
+	for name, command := range commands {
+		if len(command) == 0 {
+			return nil, nil, fmt.Errorf("the command of container %s is empty", name)
+		}
+	}
+	return nil, commands, nil
+}
+
+// getImageConfigs returns the image config of every container without an explicit command,
+// from the command hint annotation, the pod template or else the registry. Registry lookups run
+// in parallel, the results and errors are indexed like containers
+func (mw *mutatingWebhook) getImageConfigs(ctx context.Context, containers []corev1.Container, podSpec *corev1.PodSpec, ns string, smCfg secretManagerConfig) ([]*imagev1.ImageConfig, []error) {
+	imageConfigs := make([]*imagev1.ImageConfig, len(containers))
+	errs := make([]error, len(containers))
+
+	var wg sync.WaitGroup
+	for i := range containers {
+		if len(containers[i].Command) > 0 || !isContainerSelected(smCfg, containers[i]) {
+			continue
+		}
+
+		if command := commandHint(smCfg, containers[i]); command != nil {
+			mw.logger.Debugf("Using the command from annotation %s for container %s", AnnotationCommand, containers[i].Name)
+			imageConfigs[i] = &imagev1.ImageConfig{Entrypoint: command}
+			entrypointResolutions.WithLabelValues("hint").Inc()
+			continue
+		}
+
+		if imageConfigs[i] = imageConfigFor(smCfg.imageConfigs, containers[i]); imageConfigs[i] != nil {
+			mw.logger.Debugf("Using the entrypoint resolved on the pod template for container %s", containers[i].Name)
+			entrypointResolutions.WithLabelValues("pod_template").Inc()
+			continue
+		}
+
+		mw.logger.Infof("No command was given for container %s - attempting to get image metadata", containers[i].Name)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			imageConfigs[i], errs[i] = mw.registry.GetImageConfig(ctx, mw.logger.WithField("container", containers[i].Name), mw.k8sClient, ns, &containers[i], podSpec)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("cannot detect the command of container %s from image %s, set the container command or the annotation %s: %s", containers[i].Name, containers[i].Image, AnnotationCommand, errs[i])
+				return
+			}
+			entrypointResolutions.WithLabelValues("registry").Inc()
+		}(i)
+	}
+	wg.Wait()
+
+	return imageConfigs, errs
+}
+
+// resolveImageConfigs resolves the command of all the pod containers at once and applies the
+// image_config_failure_policy to the ones that cannot be resolved, it returns the warnings of
+// the containers that are admitted with the wrapper resolving their command, keyed by name
+func (mw *mutatingWebhook) resolveImageConfigs(ctx context.Context, pod *corev1.Pod, smCfg secretManagerConfig, ns string) (map[string]containerImageConfig, map[string]string, error) {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	resolved, errs := mw.getImageConfigs(ctx, containers, &pod.Spec, ns, smCfg)
+
+	imageConfigs := map[string]containerImageConfig{}
+	unresolved := map[string]string{}
+	var failures []string
+	for i, c := range containers {
+		if errs[i] != nil {
+			unresolved[c.Name] = errs[i].Error()
+			failures = append(failures, errs[i].Error())
+			continue
+		}
+		if resolved[i] != nil {
+			imageConfigs[c.Name] = containerImageConfig{Image: c.Image, Entrypoint: resolved[i].Entrypoint, Cmd: resolved[i].Cmd}
+		}
+	}
+
+	if len(failures) == 0 {
+		return imageConfigs, nil, nil
+	}
+
+	if viper.GetString("image_config_failure_policy") == imageConfigFailurePolicyAdmitWithWarning {
+		entrypointResolutions.WithLabelValues("admitted_with_warning").Add(float64(len(failures)))
+		for _, failure := range failures {
+			mw.logger.Warnf("Admitting the pod, the wrapper resolves the command of a container when it starts: %s", failure)
+		}
+		return imageConfigs, unresolved, nil
+	}
+
+	entrypointResolutions.WithLabelValues("rejected").Add(float64(len(failures)))
+	return nil, nil, fmt.Errorf("%s", strings.Join(failures, "; "))
+}
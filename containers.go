@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// parseContainerNames parses a comma separated list of container names
+func parseContainerNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isContainerSelected reports whether secrets are injected into a container. Excluded containers never are,
+// when the AnnotationContainers annotation is set only the listed containers are, and otherwise every
+// container but the sidecars of skip_containers. Listing a sidecar in the annotation selects it
+func isContainerSelected(smCfg secretManagerConfig, container corev1.Container) bool {
+	if containsName(smCfg.excludeContainers, container.Name) {
+		return false
+	}
+	if smCfg.containers != nil {
+		return containsName(smCfg.containers, container.Name)
+	}
+	return !containsName(parseContainerNames(viper.GetString("skip_containers")), container.Name)
+}
+
+// backendAnnotationPrefixes are the prefixes of the secret manager annotations that can be container scoped
+var backendAnnotationPrefixes = []string{"aws.secret.manager/", "gcp.secret.manager/", "vault.secret.manager/"}
+
+// containerScopedAnnotations returns for every container with AnnotationContainerScope annotations
+// the pod annotations overridden by them. Container scoped secret-config-N annotations replace all
+// the pod ones, the secrets of a container are a set rather than additions to the pod secrets
+func containerScopedAnnotations(annotations map[string]string) map[string]map[string]string {
+	overrides := map[string]map[string]string{}
+	for key, value := range annotations {
+		for _, prefix := range backendAnnotationPrefixes {
+			if !strings.HasPrefix(key, prefix+AnnotationContainerScope) {
+				continue
+			}
+			parts := strings.SplitN(strings.TrimPrefix(key, prefix+AnnotationContainerScope), ".", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				continue
+			}
+			if overrides[parts[0]] == nil {
+				overrides[parts[0]] = map[string]string{}
+			}
+			overrides[parts[0]][prefix+parts[1]] = value
+		}
+	}
+
+	scoped := map[string]map[string]string{}
+	for name, override := range overrides {
+		replacesSecretConfigs := false
+		for key := range override {
+			if strings.HasPrefix(key, AnnotationVaultMultiSecretPrefix) {
+				replacesSecretConfigs = true
+			}
+		}
+
+		merged := map[string]string{}
+		for key, value := range annotations {
+			if replacesSecretConfigs && strings.HasPrefix(key, AnnotationVaultMultiSecretPrefix) {
+				continue
+			}
+			merged[key] = value
+		}
+		for key, value := range override {
+			merged[key] = value
+		}
+		scoped[name] = merged
+	}
+	return scoped
+}
+
+// containerScopedKey returns the container scoped annotation of a container that overrides a backend annotation
+func containerScopedKey(key, container string) string {
+	for _, prefix := range backendAnnotationPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix + AnnotationContainerScope + container + "." + strings.TrimPrefix(key, prefix)
+		}
+	}
+	return key
+}
+
+// forContainer returns the secret manager backends of a container
+func (smCfg secretManagerConfig) forContainer(name string) secretManagerConfig {
+	if containerConfig, ok := smCfg.containerConfigs[name]; ok {
+		return containerConfig
+	}
+	return smCfg
+}
+
+// backendConfigs returns the pod backends followed by the container scoped ones sorted by container name
+func (smCfg secretManagerConfig) backendConfigs() []secretManagerConfig {
+	names := make([]string, 0, len(smCfg.containerConfigs))
+	for name := range smCfg.containerConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	configs := []secretManagerConfig{smCfg}
+	for _, name := range names {
+		configs = append(configs, smCfg.containerConfigs[name])
+	}
+	return configs
+}
+
+// isEnabled reports whether a backend is enabled for the pod or any of its containers
+func (smCfg secretManagerConfig) isEnabled() bool {
+	for _, cfg := range smCfg.backendConfigs() {
+		if cfg.aws.config.enabled || cfg.gcp.config.enabled || cfg.vault.config.enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledBackends returns the backends enabled for the pod or any of its containers
+func (smCfg secretManagerConfig) enabledBackends() []string {
+	enabled := map[string]bool{}
+	for _, cfg := range smCfg.backendConfigs() {
+		enabled["aws"] = enabled["aws"] || cfg.aws.config.enabled
+		enabled["gcp"] = enabled["gcp"] || cfg.gcp.config.enabled
+		enabled["vault"] = enabled["vault"] || cfg.vault.config.enabled
+	}
+
+	backends := []string{}
+	for _, backend := range []string{"aws", "gcp", "vault"} {
+		if enabled[backend] {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// volumeSecretNames returns the secrets mounted as pod volumes, shared by all the containers
+func (smCfg secretManagerConfig) volumeSecretNames() (gcpServiceAccountKeySecretName string, vaultTLSSecretName string) {
+	for _, cfg := range smCfg.backendConfigs() {
+		if gcpServiceAccountKeySecretName == "" && cfg.gcp.config.enabled {
+			gcpServiceAccountKeySecretName = cfg.gcp.config.serviceAccountKeySecretName
+		}
+		if vaultTLSSecretName == "" && cfg.vault.config.enabled {
+			vaultTLSSecretName = cfg.vault.config.tlsSecretName
+		}
+	}
+	return gcpServiceAccountKeySecretName, vaultTLSSecretName
+}
+
+// validate checks the settings each enabled backend requires and returns all the missing ones
+func (smCfg secretManagerConfig) validate() error {
+	var errs []error
+
+	if smCfg.aws.config.enabled && smCfg.aws.config.secretName == "" {
+		errs = append(errs, fmt.Errorf("Error getting aws secret name - make sure you set the annotation %s on the Pod", AnnotationAWSSecretManagerSecretName))
+	}
+
+	if smCfg.gcp.config.enabled {
+		if smCfg.gcp.config.projectID == "" {
+			errs = append(errs, fmt.Errorf("Error getting gcp project id - make sure you set the annotation %s on the Pod", AnnotationGCPSecretManagerProjectID))
+		}
+		if smCfg.gcp.config.secretName == "" {
+			errs = append(errs, fmt.Errorf("Error getting gcp secret name - make sure you set the annotation %s on the Pod", AnnotationGCPSecretManagerSecretName))
+		}
+	}
+
+	if smCfg.vault.config.enabled {
+		if smCfg.vault.config.addr == "" {
+			errs = append(errs, fmt.Errorf("Error getting vault service address - make sure you set the annotation %s on the Pod", AnnotationVaultService))
+		}
+
+		if smCfg.vault.config.path == "" && len(smCfg.vault.config.secretConfigs) == 0 {
+			errs = append(errs, fmt.Errorf("Error getting vault secret path - make sure you either set the annotation %s or use the annotation %sx where x is the secret number", AnnotationVaultSecretPath, AnnotationVaultMultiSecretPrefix))
+		}
+
+		if smCfg.vault.config.role == "" {
+			errs = append(errs, fmt.Errorf("Error getting vault role - make sure you set the annotation %s", AnnotationVaultRole))
+		}
+
+		if smCfg.vault.config.tlsSecretName != "" && smCfg.vault.config.vaultCACert == "" {
+			errs = append(errs, fmt.Errorf("Error getting CA cert filename - make sure you set the annotation %s with the CA cert file name", AnnotationVaultCACert))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// validatePod validates the backends of every container secrets are injected into, and that
+// the containers agree on the secrets mounted as pod volumes. It returns all the problems at once
+func (smCfg secretManagerConfig) validatePod(podSpec *corev1.PodSpec) error {
+	var errs []error
+
+	if smCfg.commandHintErr != nil {
+		errs = append(errs, fmt.Errorf("annotation %s: %s", AnnotationCommand, smCfg.commandHintErr))
+	}
+	errs = append(errs, smCfg.annotationErrs...)
+
+	volumeSecrets := map[string]string{}
+	checkVolumeSecret := func(volume, secretName string) {
+		if secretName == "" {
+			return
+		}
+		if known, ok := volumeSecrets[volume]; ok && known != secretName {
+			errs = append(errs, fmt.Errorf("containers use the secrets %s and %s for the %s volume, it is shared by the whole pod", known, secretName, volume))
+			return
+		}
+		volumeSecrets[volume] = secretName
+	}
+
+	for _, scope := range smCfg.configScopes(podSpec) {
+		if scope.container != "" {
+			if err := scope.cfg.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("container %s: %s", scope.container, err))
+			}
+		} else if agg, ok := scope.cfg.validate().(utilerrors.Aggregate); ok {
+			// the containers without container scoped annotations share the pod settings, report them once
+			errs = append(errs, agg.Errors()...)
+		}
+
+		if scope.cfg.gcp.config.enabled {
+			checkVolumeSecret(VolumeMountGoogleCloudKeyName, scope.cfg.gcp.config.serviceAccountKeySecretName)
+		}
+		if scope.cfg.vault.config.enabled {
+			checkVolumeSecret(VaultTLSVolumeName, scope.cfg.vault.config.tlsSecretName)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// configScope is the settings shared by containers selected for injection: the pod annotations,
+// or the container scoped annotations of a single container
+type configScope struct {
+	container  string // empty for the pod annotations
+	cfg        secretManagerConfig
+	containers []corev1.Container
+}
+
+// configScopes groups the containers selected for injection by the settings they use, in the
+// order of their first container
+func (smCfg secretManagerConfig) configScopes(podSpec *corev1.PodSpec) []configScope {
+	var scopes []configScope
+	podScope := -1
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		if !isContainerSelected(smCfg, container) {
+			continue
+		}
+		if cfg, ok := smCfg.containerConfigs[container.Name]; ok {
+			scopes = append(scopes, configScope{container: container.Name, cfg: cfg, containers: []corev1.Container{container}})
+			continue
+		}
+		if podScope == -1 {
+			// the pod settings alone, without the backends of the container scoped annotations
+			podCfg := smCfg
+			podCfg.containerConfigs = nil
+			podScope = len(scopes)
+			scopes = append(scopes, configScope{cfg: podCfg})
+		}
+		scopes[podScope].containers = append(scopes[podScope].containers, container)
+	}
+	return scopes
+}
+
+// insecureTLS reports the settings of the pod that read secrets without TLS or without verifying
+// the certificate of the secret manager. The admission allows them, the lint command reports them.
+// The GCP client cannot be configured without TLS
+func (smCfg secretManagerConfig) insecureTLS(podSpec *corev1.PodSpec) []error {
+	var errs []error
+	for _, scope := range smCfg.configScopes(podSpec) {
+		prefix := ""
+		if scope.container != "" {
+			prefix = fmt.Sprintf("container %s: ", scope.container)
+		}
+
+		if vault := scope.cfg.vault.config; vault.enabled && vault.addr != "" {
+			switch {
+			case strings.HasPrefix(vault.addr, "http://"):
+				errs = append(errs, fmt.Errorf("%sVault %s is read without TLS, use https://", prefix, vault.addr))
+			case vault.tlsSecretName == "" && vault.vaultCACert != "":
+				errs = append(errs, fmt.Errorf("%sannotation %s is ignored without the annotation %s, the certificate of Vault %s is not verified", prefix, AnnotationVaultCACert, AnnotationVaultTLSSecret, vault.addr))
+			case vault.tlsSecretName == "":
+				errs = append(errs, fmt.Errorf("%sthe certificate of Vault %s is not verified without the annotations %s and %s", prefix, vault.addr, AnnotationVaultTLSSecret, AnnotationVaultCACert))
+			}
+		}
+
+		// the env of the containers overrides the settings the wrapper gets from the annotations
+		for _, container := range scope.containers {
+			for _, env := range container.Env {
+				switch {
+				case scope.cfg.vault.config.enabled && env.Name == "VAULT_SKIP_VERIFY" && env.Value != "" && env.Value != "false" && env.Value != "0":
+					errs = append(errs, fmt.Errorf("container %s: %s is set, the certificate of Vault is not verified", container.Name, env.Name))
+				case scope.cfg.vault.config.enabled && env.Name == "VAULT_ADDR" && strings.HasPrefix(env.Value, "http://"):
+					errs = append(errs, fmt.Errorf("container %s: %s is %s, Vault is read without TLS", container.Name, env.Name, env.Value))
+				case scope.cfg.aws.config.enabled && (env.Name == "AWS_ENDPOINT_URL" || env.Name == "AWS_ENDPOINT_URL_SECRETS_MANAGER") && strings.HasPrefix(env.Value, "http://"):
+					errs = append(errs, fmt.Errorf("container %s: %s is %s, AWS Secrets Manager is read without TLS", container.Name, env.Name, env.Value))
+				}
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// secretPrefixes of the env values referencing a secret manager key
+var secretPrefixes = []string{"vault:", ">>secret:", "secret:"}
+
+func hasSecretPrefix(value string) bool {
+	for _, prefix := range secretPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretKey returns the secret manager key an env value references
+func secretKey(value string) string {
+	for _, prefix := range secretPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return strings.TrimPrefix(value, prefix)
+		}
+	}
+	return ""
+}
+
+// referencedSecretKeys returns the sorted and unique keys referenced by env vars
+func referencedSecretKeys(envVars []corev1.EnvVar) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, env := range envVars {
+		if key := secretKey(env.Value); key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+func (mw *mutatingWebhook) getDataFromConfigmap(ctx context.Context, cmName string, ns string) (map[string]string, error) {
+	configMap, err := mw.getConfigMap(ctx, cmName, ns)
+	if err != nil {
+		return nil, err
+	}
+	return configMap.Data, nil
+}
+
+func (mw *mutatingWebhook) getDataFromSecret(ctx context.Context, secretName string, ns string) (map[string][]byte, error) {
+	secret, err := mw.getSecret(ctx, secretName, ns)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// resolveValueFrom returns the value kubelet gives to an env var with a ConfigMap or Secret key
+// reference, set is false when kubelet would leave the var unset: a missing object or key that is
+// optional, or one that is not and fails the container start anyway
+func (mw *mutatingWebhook) resolveValueFrom(ctx context.Context, env corev1.EnvVar, ns string) (value string, set bool, err error) {
+	ctx, span := startSpan(ctx, "references.value_from", attribute.String("env.name", env.Name))
+	defer func() { endSpan(span, err) }()
+
+	if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+		data, err := mw.getDataFromConfigmap(ctx, ref.Name, ns)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		value, set = data[ref.Key]
+		return value, set, nil
+	}
+
+	if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+		data, err := mw.getDataFromSecret(ctx, ref.Name, ns)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		b, set := data[ref.Key]
+		return string(b), set, nil
+	}
+
+	// fieldRef and resourceFieldRef never hold secret references but still set the var
+	return "", true, nil
+}
+
+func (mw *mutatingWebhook) lookForValueFrom(ctx context.Context, env corev1.EnvVar, ns string) (*corev1.EnvVar, error) {
+	value, set, err := mw.resolveValueFrom(ctx, env, ns)
+	if err != nil || !set || !hasSecretPrefix(value) {
+		return nil, err
+	}
+	return &corev1.EnvVar{Name: env.Name, Value: value}, nil
+}
+
+// envFromValues returns every env var defined by the envFrom sources like kubelet does:
+// keys are prefixed, keys that are not valid env var names are skipped, and later sources
+// override earlier ones. Missing objects are skipped, kubelet fails the container start
+// for the ones that are not optional
+func (mw *mutatingWebhook) envFromValues(ctx context.Context, envFrom []corev1.EnvFromSource, ns string) (values map[string]string, err error) {
+	values = map[string]string{}
+	if len(envFrom) == 0 {
+		return values, nil
+	}
+
+	ctx, span := startSpan(ctx, "references.env_from", attribute.Int("env_from.sources", len(envFrom)))
+	defer func() { endSpan(span, err) }()
+
+	set := func(prefix, key, value string) {
+		name := prefix + key
+		if len(validation.IsEnvVarName(name)) > 0 {
+			mw.logger.Debugf("Skipping envFrom key %s, it is not a valid env var name", name)
+			return
+		}
+		values[name] = value
+	}
+
+	for _, ef := range envFrom {
+		if ef.ConfigMapRef != nil {
+			data, err := mw.getDataFromConfigmap(ctx, ef.ConfigMapRef.Name, ns)
+			if err != nil {
+				if apierrors.IsNotFound(err) || isOptional(ef.ConfigMapRef.Optional) {
+					continue
+				}
+				return nil, err
+			}
+			for key, value := range data {
+				set(ef.Prefix, key, value)
+			}
+		}
+		if ef.SecretRef != nil {
+			data, err := mw.getDataFromSecret(ctx, ef.SecretRef.Name, ns)
+			if err != nil {
+				if apierrors.IsNotFound(err) || isOptional(ef.SecretRef.Optional) {
+					continue
+				}
+				return nil, err
+			}
+			for key, value := range data {
+				set(ef.Prefix, key, string(value))
+			}
+		}
+	}
+	return values, nil
+}
+
+func (mw *mutatingWebhook) lookForEnvFrom(ctx context.Context, envFrom []corev1.EnvFromSource, ns string) ([]corev1.EnvVar, error) {
+	values, err := mw.envFromValues(ctx, envFrom, ns)
+	if err != nil {
+		return nil, err
+	}
+	return secretReferences(values), nil
+}
+
+// secretEnvReferences returns the env vars of a container whose final value, as kubelet computes it,
+// is a secret reference. env entries override envFrom and the last entry of a name wins
+func (mw *mutatingWebhook) secretEnvReferences(ctx context.Context, container corev1.Container, ns string) ([]corev1.EnvVar, error) {
+	values, err := mw.envFromValues(ctx, container.EnvFrom, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, env := range container.Env {
+		if env.ValueFrom == nil {
+			values[env.Name] = env.Value
+			continue
+		}
+
+		value, set, err := mw.resolveValueFrom(ctx, env, ns)
+		if err != nil {
+			return nil, err
+		}
+		if set {
+			values[env.Name] = value
+		}
+	}
+
+	return secretReferences(values), nil
+}
+
+// secretReferences returns the values holding a secret reference sorted by name,
+// so that the mutation does not depend on map iteration order
+func secretReferences(values map[string]string) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for name, value := range values {
+		if hasSecretPrefix(value) {
+			envVars = append(envVars, corev1.EnvVar{Name: name, Value: value})
+		}
+	}
+	sort.Slice(envVars, func(i, j int) bool {
+		return envVars[i].Name < envVars[j].Name
+	})
+	return envVars
+}
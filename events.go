@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Events recorded on the controllers of the admitted pods
+const (
+	eventReasonInjected          = "SecretsInjected"
+	eventReasonSkipped           = "SecretsInjectionSkipped"
+	eventReasonFailed            = "SecretsInjectionFailed"
+	eventReasonCommandUnresolved = "SecretsCommandUnresolved"
+)
+
+// newEventRecorder records the Events with the webhook as source
+func newEventRecorder(client kubernetes.Interface, logger log.FieldLogger) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(logger.Debugf)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "secrets-consumer-webhook"})
+}
+
+// recordEvent tells the owners of the pod what the admission did, so that they see it with kubectl describe.
+// Nothing is recorded for dry runs and reinvocations, nor for the pods that have none of the webhook
+// annotations. The target is resolved in the background, it may need to read the ReplicaSet
+func (mw *mutatingWebhook) recordEvent(ctx context.Context, pod *corev1.Pod, smCfg secretManagerConfig, outcome, reason string, err error) {
+	if mw.recorder == nil || whcontext.IsAdmissionRequestDryRun(ctx) || reason == reasonAlreadyMutated {
+		return
+	}
+
+	eventType, eventReason, message := corev1.EventTypeNormal, eventReasonSkipped, ""
+	switch {
+	case outcome == "rejected":
+		eventType, eventReason = corev1.EventTypeWarning, eventReasonFailed
+		message = fmt.Sprintf("Rejected pod %s: %s", podName(pod), err)
+	case reason == reasonNotEnabled:
+		if !hasOwnedAnnotation(pod.Annotations) {
+			return
+		}
+		message = fmt.Sprintf("Skipped pod %s: no secret manager is enabled, set %s, %s or %s to true",
+			podName(pod), AnnotationAWSSecretManagerEnabled, AnnotationGCPSecretManagerEnabled, AnnotationVaultEnabled)
+	case reason == reasonNoContainers && pod.Annotations[AnnotationWarning] != "":
+		eventType = corev1.EventTypeWarning
+		message = fmt.Sprintf("Skipped pod %s: %s", podName(pod), pod.Annotations[AnnotationWarning])
+	case reason == reasonNoContainers:
+		message = fmt.Sprintf("Skipped pod %s: no container needs secrets, they are excluded, skipped sidecars or reference no secrets", podName(pod))
+	default:
+		eventReason = eventReasonInjected
+		message = injectedMessage(pod, smCfg)
+	}
+
+	ns := pod.Namespace
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil && ar.Namespace != "" {
+		ns = ar.Namespace
+	}
+	pod = pod.DeepCopy()
+
+	go func() {
+		target := mw.eventTarget(pod, ns)
+		if target == nil {
+			mw.logger.Debugf("No object to record the %s event of pod %s on", eventReason, podName(pod))
+			return
+		}
+		mw.recorder.Event(target, eventType, eventReason, message)
+	}()
+}
+
+// recordUnresolvedCommands warns the owners of the pod once for every container the admit-with-warning
+// policy admitted without a detected command, as each needs its command set or its image reachable
+func (mw *mutatingWebhook) recordUnresolvedCommands(ctx context.Context, pod *corev1.Pod, failures []string) {
+	if mw.recorder == nil || whcontext.IsAdmissionRequestDryRun(ctx) || len(failures) == 0 {
+		return
+	}
+
+	ns := pod.Namespace
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil && ar.Namespace != "" {
+		ns = ar.Namespace
+	}
+	pod = pod.DeepCopy()
+
+	go func() {
+		target := mw.eventTarget(pod, ns)
+		if target == nil {
+			mw.logger.Debugf("No object to record the %s events of pod %s on", eventReasonCommandUnresolved, podName(pod))
+			return
+		}
+		for _, failure := range failures {
+			mw.recorder.Event(target, corev1.EventTypeWarning, eventReasonCommandUnresolved,
+				fmt.Sprintf("Admitted pod %s, the wrapper resolves the command when the container starts: %s", podName(pod), failure))
+		}
+	}()
+}
+
+// eventTarget returns the object the events of a pod are recorded on: the Deployment of its
+// ReplicaSet, or its controller, e.g. a Job, a StatefulSet or a DaemonSet. The pod itself is
+// only used without a controller, when it has a name, as the pods of controllers get theirs
+// generated after the admission
+func (mw *mutatingWebhook) eventTarget(pod *corev1.Pod, ns string) *corev1.ObjectReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		if pod.Name == "" {
+			return nil
+		}
+		return &corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: ns, Name: pod.Name, UID: pod.UID}
+	}
+
+	if owner.Kind == "ReplicaSet" {
+		rs, err := mw.k8sClient.AppsV1().ReplicaSets(ns).Get(owner.Name, metav1.GetOptions{})
+		if err != nil {
+			mw.logger.Debugf("Cannot get the ReplicaSet %s/%s of pod %s, recording the event on it: %s", ns, owner.Name, podName(pod), err)
+		} else if deployment := metav1.GetControllerOf(rs); deployment != nil && deployment.Kind == "Deployment" {
+			owner = deployment
+		}
+	}
+
+	return &corev1.ObjectReference{APIVersion: owner.APIVersion, Kind: owner.Kind, Namespace: ns, Name: owner.Name, UID: owner.UID}
+}
+
+// injectedMessage lists the backends and containers of a mutated pod
+func injectedMessage(pod *corev1.Pod, smCfg secretManagerConfig) string {
+	status := newInjectionStatus(pod, smCfg)
+
+	var containers []string
+	if len(status.InitContainers) > 0 {
+		containers = append(containers, "init containers "+strings.Join(status.InitContainers, ", "))
+	}
+	if len(status.Containers) > 0 {
+		containers = append(containers, "containers "+strings.Join(status.Containers, ", "))
+	}
+	return fmt.Sprintf("Injected %s secrets into %s of pod %s", strings.Join(status.Backends, ", "), strings.Join(containers, " and "), podName(pod))
+}
+
+// podName is the name of a pod, or its generateName prefix before the admission
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+func hasOwnedAnnotation(annotations map[string]string) bool {
+	for key := range annotations {
+		if isOwnedAnnotation(key) {
+			return true
+		}
+	}
+	return false
+}
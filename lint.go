@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/innovia/secrets-consumer-webhook/version"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// Severities of the lint findings, named after the SARIF levels
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+// lintRules are the checks of the lint command and what they report
+var lintRules = map[string]string{
+	"invalid-manifest":      "The document is not valid YAML or not a valid Kubernetes object",
+	"unknown-annotation":    "The annotation is not supported by the webhook, it is likely misspelled",
+	"invalid-annotation":    "The value of the annotation is invalid",
+	"invalid-secret-config": "The JSON of a vault.secret.manager/secret-config-N annotation is invalid",
+	"invalid-config":        "A setting the enabled secret manager requires is missing, the pod would be rejected",
+	"misplaced-annotation":  "The annotation is set on the workload instead of its pod template, it is ignored",
+	"insecure-tls":          "The secrets are read without TLS or without verifying the certificate of the secret manager",
+	"policy":                "The configuration is not allowed by the lint policy",
+}
+
+// lintFinding is a problem found in a document
+type lintFinding struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Document int    `json:"document"`
+	Object   string `json:"object"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// lintPolicy are the rules of a platform on top of the checks of the webhook
+type lintPolicy struct {
+	// AllowedBackends are the secret managers the pods may use: aws, gcp or vault
+	AllowedBackends []string `json:"allowedBackends,omitempty"`
+	// AllowedVaultAddresses are the Vault servers the pods may read from
+	AllowedVaultAddresses []string `json:"allowedVaultAddresses,omitempty"`
+	// RequireExplicitSecrets requires the AnnotationExplicitSecrets annotation
+	RequireExplicitSecrets bool `json:"requireExplicitSecrets,omitempty"`
+	// RequireTLS reports the insecure TLS settings as errors
+	RequireTLS bool `json:"requireTLS,omitempty"`
+}
+
+// lintCommand checks the pods and pod templates of multi-document YAML files, or of stdin, that use
+// the webhook annotations, with the checks of the admission and the optional policy. It exits with
+// 1 when an error is found
+func lintCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output format: text, json or sarif")
+	policyFile := flags.String("policy", "", "YAML policy: allowedBackends, allowedVaultAddresses, requireExplicitSecrets and requireTLS")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s lint [flags] [file...]\n\nChecks the secrets annotations of the pods and pod templates of the files, - or no file for stdin.\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fmt.Fprintf(stderr, "invalid format %q, expected text, json or sarif\n", *format)
+		return 2
+	}
+
+	var policy lintPolicy
+	if *policyFile != "" {
+		data, err := ioutil.ReadFile(*policyFile)
+		if err == nil {
+			err = yaml.UnmarshalStrict(data, &policy)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "cannot read policy %s: %s\n", *policyFile, err)
+			return 2
+		}
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	// the problems are reported as findings, not logged
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	mw := &mutatingWebhook{logger: logger}
+
+	findings := []lintFinding{}
+	for _, file := range files {
+		findings = append(findings, mw.lintFile(file, stdin, policy)...)
+	}
+
+	var err error
+	switch *format {
+	case "json":
+		err = writeJSON(stdout, findings)
+	case "sarif":
+		err = writeJSON(stdout, sarifLog(findings))
+	default:
+		writeLintText(stdout, findings)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	for _, finding := range findings {
+		if finding.Severity == lintError {
+			return 1
+		}
+	}
+	return 0
+}
+
+// lintFile returns the findings of the documents of a file
+func (mw *mutatingWebhook) lintFile(file string, stdin io.Reader, policy lintPolicy) []lintFinding {
+	docs, err := readManifestFile(file, stdin)
+	if err != nil {
+		return []lintFinding{{File: file, Rule: "invalid-manifest", Severity: lintError, Message: err.Error()}}
+	}
+
+	var findings []lintFinding
+	for i, doc := range docs {
+		for _, finding := range mw.lintDocument(doc.data, policy) {
+			finding.File, finding.Line, finding.Document = file, doc.line, i+1
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// lintDocument checks a Pod, or the pod template of a workload, that uses the webhook annotations.
+// The other objects are ignored
+func (mw *mutatingWebhook) lintDocument(doc []byte, policy lintPolicy) []lintFinding {
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+	if k8sruntime.IsNotRegisteredError(err) || k8sruntime.IsMissingKind(err) {
+		return nil
+	}
+	if err != nil {
+		return []lintFinding{{Rule: "invalid-manifest", Severity: lintError, Message: err.Error()}}
+	}
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return nil
+	}
+
+	var findings []lintFinding
+	report := func(rule, severity, format string, args ...interface{}) {
+		findings = append(findings, lintFinding{
+			Object:   gvk.Kind + "/" + meta.GetName(),
+			Rule:     rule,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	var podMeta *metav1.ObjectMeta
+	var podSpec *corev1.PodSpec
+	if template := podTemplateSpec(meta); template != nil {
+		podMeta, podSpec = &template.ObjectMeta, &template.Spec
+		for _, key := range sortedKeys(meta.GetAnnotations()) {
+			if isOwnedAnnotation(key) {
+				report("misplaced-annotation", lintError, "annotation %s is set on the %s, move it to the pod template", key, gvk.Kind)
+			}
+		}
+	} else if pod, ok := obj.(*corev1.Pod); ok {
+		podMeta, podSpec = &pod.ObjectMeta, &pod.Spec
+	} else {
+		return findings
+	}
+	if !hasOwnedAnnotation(podMeta.Annotations) {
+		return findings
+	}
+
+	// the admission checks, split by annotation to tell the problems apart
+	schema, err := annotationSchema(podMeta.Annotations)
+	if err != nil {
+		report("invalid-annotation", lintError, "%s", err)
+		return findings
+	}
+	for _, key := range sortedKeys(podMeta.Annotations) {
+		if !isOwnedAnnotation(key) {
+			continue
+		}
+		spec, lookup, ok := lookupAnnotation(schema, key)
+		if !ok {
+			report("unknown-annotation", lintError, "%s", unknownAnnotationError(key, schema))
+			continue
+		}
+		if err := spec.check(lookup, podMeta.Annotations[key]); err != nil {
+			rule := "invalid-annotation"
+			if schemaKey(lookup) == AnnotationVaultMultiSecretPrefix+"N" {
+				rule = "invalid-secret-config"
+			}
+			report(rule, lintError, "annotation %s: %s", key, err)
+		}
+	}
+
+	smCfg := mw.parseSecretManagerConfig(podMeta)
+	if !smCfg.isEnabled() {
+		return findings
+	}
+	reported := map[string]bool{}
+	for _, finding := range findings {
+		reported[finding.Message] = true
+	}
+	if agg, ok := smCfg.validatePod(podSpec).(utilerrors.Aggregate); ok {
+		for _, err := range agg.Errors() {
+			// the invalid booleans are already reported as invalid-annotation
+			if !reported[err.Error()] {
+				report("invalid-config", lintError, "%s", err)
+			}
+		}
+	}
+
+	tlsSeverity := lintWarning
+	if policy.RequireTLS {
+		tlsSeverity = lintError
+	}
+	for _, err := range smCfg.insecureTLS(podSpec) {
+		report("insecure-tls", tlsSeverity, "%s", err)
+	}
+
+	for _, scope := range smCfg.configScopes(podSpec) {
+		prefix := ""
+		if scope.container != "" {
+			prefix = fmt.Sprintf("container %s: ", scope.container)
+		}
+		for _, backend := range scope.cfg.enabledBackends() {
+			if len(policy.AllowedBackends) > 0 && !containsName(policy.AllowedBackends, backend) {
+				report("policy", lintError, "%sthe %s secret manager is not allowed, use %s", prefix, backend, strings.Join(policy.AllowedBackends, ", "))
+			}
+		}
+		if addr := scope.cfg.vault.config.addr; scope.cfg.vault.config.enabled && addr != "" && len(policy.AllowedVaultAddresses) > 0 && !containsName(policy.AllowedVaultAddresses, addr) {
+			report("policy", lintError, "%sVault %s is not allowed, use %s", prefix, addr, strings.Join(policy.AllowedVaultAddresses, ", "))
+		}
+	}
+
+	if policy.RequireExplicitSecrets && !smCfg.explicitSecrets {
+		report("policy", lintError, "annotation %s must be \"true\", to only expose the referenced secrets", AnnotationExplicitSecrets)
+	}
+
+	return findings
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeLintText prints the findings like compilers do, file:line, followed by a summary
+func writeLintText(w io.Writer, findings []lintFinding) {
+	errors, warnings := 0, 0
+	for _, f := range findings {
+		location := f.File
+		if f.Line > 0 {
+			location = fmt.Sprintf("%s:%d", f.File, f.Line)
+		}
+		object := ""
+		if f.Object != "" {
+			object = " " + f.Object + ":"
+		}
+		fmt.Fprintf(w, "%s:%s %s: %s [%s]\n", location, object, f.Severity, f.Message, f.Rule)
+
+		if f.Severity == lintError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	fmt.Fprintf(w, "%d errors, %d warnings\n", errors, warnings)
+}
+
+// sarifLog is the SARIF 2.1.0 log of the findings, for code scanning tools
+func sarifLog(findings []lintFinding) map[string]interface{} {
+	ids := make([]string, 0, len(lintRules))
+	for id := range lintRules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rules := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rules = append(rules, map[string]interface{}{
+			"id":               id,
+			"shortDescription": map[string]string{"text": lintRules[id]},
+		})
+	}
+
+	results := make([]map[string]interface{}, 0, len(findings))
+	for _, f := range findings {
+		uri := f.File
+		if uri == "-" {
+			uri = "stdin"
+		}
+		physical := map[string]interface{}{"artifactLocation": map[string]string{"uri": filepath.ToSlash(uri)}}
+		if f.Line > 0 {
+			physical["region"] = map[string]int{"startLine": f.Line}
+		}
+		location := map[string]interface{}{"physicalLocation": physical}
+		if f.Object != "" {
+			location["logicalLocations"] = []map[string]string{{"fullyQualifiedName": f.Object}}
+		}
+
+		results = append(results, map[string]interface{}{
+			"ruleId":    f.Rule,
+			"level":     f.Severity,
+			"message":   map[string]string{"text": f.Message},
+			"locations": []map[string]interface{}{location},
+		})
+	}
+
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []map[string]interface{}{{
+			"tool": map[string]interface{}{
+				"driver": map[string]interface{}{
+					"name":    "secrets-consumer-webhook",
+					"version": version.GetVersion(),
+					"rules":   rules,
+				},
+			},
+			"results": results,
+		}},
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+)
+
+func Test_lintCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := `# rendered by helm
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  annotations:
+    vault.secret.manager/enabled: "true"
+spec:
+  selector: {matchLabels: {app: api}}
+  template:
+    metadata:
+      annotations:
+        vault.secret.manager/enabled: "true"
+        vault.secret.manager/servce: https://vault:8200
+        vault.secret.manager/role: api
+        vault.secret.manager/secret-config-1: '{"path": }'
+    spec:
+      containers:
+      - {name: app, image: app:1.0}
+---
+apiVersion: v1
+kind: Service
+metadata: {name: api}
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    vault.secret.manager/enabled: "true"
+    vault.secret.manager/service: http://vault:8200
+    vault.secret.manager/role: web
+    vault.secret.manager/path: secret/web
+spec:
+  containers:
+  - {name: app, image: app:1.0}
+`
+	valid := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    aws.secret.manager/enabled: "true"
+    aws.secret.manager/secret-name: web/prod
+spec:
+  containers:
+  - {name: app, image: app:1.0}
+`
+	files := map[string]string{
+		"valid.yaml":  valid,
+		"policy.yaml": "allowedBackends: [vault]\nrequireTLS: true\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		if exitCode := lintCommand(nil, strings.NewReader(manifest), &stdout, &stderr); exitCode != 1 {
+			t.Errorf("expected exit code 1, got %d: %s", exitCode, stderr.String())
+		}
+		for _, want := range []string{
+			"-:2: Deployment/api: error: annotation vault.secret.manager/enabled is set on the Deployment, move it to the pod template [misplaced-annotation]",
+			"-:2: Deployment/api: error: unknown annotation vault.secret.manager/servce, did you mean vault.secret.manager/service? [unknown-annotation]",
+			`-:2: Deployment/api: error: annotation vault.secret.manager/secret-config-1: invalid JSON "{\"path\": }" [invalid-secret-config]`,
+			"-:2: Deployment/api: error: Error getting vault service address",
+			"-:25: Pod/web: warning: Vault http://vault:8200 is read without TLS, use https:// [insecure-tls]",
+			"5 errors, 1 warnings\n",
+		} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("expected %q in the output:\n%s", want, stdout.String())
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		if exitCode := lintCommand([]string{"--format", "json", dir + "/valid.yaml"}, nil, &stdout, &stderr); exitCode != 0 {
+			t.Errorf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+		}
+		var findings []lintFinding
+		if err := json.Unmarshal([]byte(stdout.String()), &findings); err != nil {
+			t.Fatal(err)
+		}
+		if len(findings) != 0 {
+			t.Errorf("expected no findings, got %+v", findings)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		args := []string{"--format", "json", "--policy", dir + "/policy.yaml", dir + "/valid.yaml", "-"}
+		if exitCode := lintCommand(args, strings.NewReader(manifest), &stdout, &stderr); exitCode != 1 {
+			t.Errorf("expected exit code 1, got %d: %s", exitCode, stderr.String())
+		}
+		var findings []lintFinding
+		if err := json.Unmarshal([]byte(stdout.String()), &findings); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]lintFinding{
+			"policy": {File: dir + "/valid.yaml", Line: 1, Document: 1, Object: "Pod/web", Rule: "policy", Severity: lintError,
+				Message: "the aws secret manager is not allowed, use vault"},
+			"insecure-tls": {File: "-", Line: 25, Document: 3, Object: "Pod/web", Rule: "insecure-tls", Severity: lintError,
+				Message: "Vault http://vault:8200 is read without TLS, use https://"},
+		}
+		for _, finding := range findings {
+			if expected, ok := want[finding.Rule]; ok && !cmp.Equal(finding, expected) {
+				t.Errorf("%s", cmp.Diff(expected, finding))
+			}
+		}
+	})
+
+	t.Run("insecure tls", func(t *testing.T) {
+		manifest := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    vault.secret.manager/enabled: "true"
+    vault.secret.manager/service: https://vault:8200
+    vault.secret.manager/role: web
+    vault.secret.manager/path: secret/web
+    vault.secret.manager/ca-cert: ca.crt
+    aws.secret.manager/container.worker.enabled: "true"
+    aws.secret.manager/container.worker.secret-name: web/prod
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+    env: [{name: VAULT_SKIP_VERIFY, value: "true"}]
+  - name: worker
+    image: app:1.0
+    env: [{name: AWS_ENDPOINT_URL, value: "http://localstack:4566"}]
+`
+		var stdout, stderr strings.Builder
+		if exitCode := lintCommand([]string{"--policy", dir + "/policy.yaml"}, strings.NewReader(manifest), &stdout, &stderr); exitCode != 1 {
+			t.Errorf("expected exit code 1, got %d: %s", exitCode, stderr.String())
+		}
+		for _, want := range []string{
+			"-:1: Pod/web: error: annotation vault.secret.manager/ca-cert is ignored without the annotation vault.secret.manager/tls-secret, the certificate of Vault https://vault:8200 is not verified [insecure-tls]",
+			"-:1: Pod/web: error: container app: VAULT_SKIP_VERIFY is set, the certificate of Vault is not verified [insecure-tls]",
+			"-:1: Pod/web: error: container worker: annotation vault.secret.manager/ca-cert is ignored without the annotation vault.secret.manager/tls-secret, the certificate of Vault https://vault:8200 is not verified [insecure-tls]",
+			"-:1: Pod/web: error: container worker: AWS_ENDPOINT_URL is http://localstack:4566, AWS Secrets Manager is read without TLS [insecure-tls]",
+			"-:1: Pod/web: error: container worker: the aws secret manager is not allowed, use vault [policy]",
+			"5 errors, 0 warnings\n",
+		} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("expected %q in the output:\n%s", want, stdout.String())
+			}
+		}
+	})
+
+	t.Run("sarif", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		lintCommand([]string{"--format", "sarif"}, strings.NewReader(manifest), &stdout, &stderr)
+
+		var log struct {
+			Version string `json:"version"`
+			Runs    []struct {
+				Tool struct {
+					Driver struct {
+						Rules []struct {
+							ID string `json:"id"`
+						} `json:"rules"`
+					} `json:"driver"`
+				} `json:"tool"`
+				Results []struct {
+					RuleID    string `json:"ruleId"`
+					Level     string `json:"level"`
+					Locations []struct {
+						PhysicalLocation struct {
+							ArtifactLocation struct {
+								URI string `json:"uri"`
+							} `json:"artifactLocation"`
+							Region struct {
+								StartLine int `json:"startLine"`
+							} `json:"region"`
+						} `json:"physicalLocation"`
+					} `json:"locations"`
+				} `json:"results"`
+			} `json:"runs"`
+		}
+		if err := json.Unmarshal([]byte(stdout.String()), &log); err != nil {
+			t.Fatal(err)
+		}
+		if log.Version != "2.1.0" || len(log.Runs) != 1 || len(log.Runs[0].Tool.Driver.Rules) != len(lintRules) {
+			t.Fatalf("unexpected SARIF log: %s", stdout.String())
+		}
+		results := log.Runs[0].Results
+		if len(results) != 6 {
+			t.Fatalf("expected 6 results, got %d", len(results))
+		}
+		last := results[len(results)-1]
+		if last.RuleID != "insecure-tls" || last.Level != "warning" || last.Locations[0].PhysicalLocation.ArtifactLocation.URI != "stdin" || last.Locations[0].PhysicalLocation.Region.StartLine != 25 {
+			t.Errorf("unexpected result %+v", last)
+		}
+	})
+
+	t.Run("invalid yaml", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		if exitCode := lintCommand(nil, strings.NewReader("kind: Pod\n  name: [\n"), &stdout, &stderr); exitCode != 1 {
+			t.Errorf("expected exit code 1, got %d", exitCode)
+		}
+		if !strings.Contains(stdout.String(), "[invalid-manifest]") {
+			t.Errorf("expected an invalid-manifest error, got %s", stdout.String())
+		}
+	})
+}
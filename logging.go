@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newLogger returns the logger of the webhook, logging JSON with enable_json_log and at the
+// debug level with debug. The level can be changed afterwards with the logLevelHandler
+func newLogger() *log.Logger {
+	logger := log.New()
+
+	if viper.GetBool("enable_json_log") {
+		logger.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if viper.GetBool("debug") {
+		logger.SetLevel(log.DebugLevel)
+		logger.Debug("Debug mode enabled")
+	}
+
+	return logger
+}
+
+// forRequest returns a copy of the webhook logging with the admission UID, the namespace and the
+// name or generateName of the admitted object, so that the logs of concurrent admissions can be
+// told apart
+func (mw *mutatingWebhook) forRequest(ctx context.Context, obj metav1.Object) *mutatingWebhook {
+	fields := log.Fields{"namespace": obj.GetNamespace()}
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		if ar.UID != "" {
+			fields["admission_uid"] = string(ar.UID)
+		}
+		if ar.Kind.Kind != "" {
+			fields["kind"] = ar.Kind.Kind
+		}
+		// the pods of controllers get their namespace after the admission
+		if ar.Namespace != "" {
+			fields["namespace"] = ar.Namespace
+		}
+	}
+	if obj.GetName() != "" {
+		fields["name"] = obj.GetName()
+	} else if obj.GetGenerateName() != "" {
+		fields["generate_name"] = obj.GetGenerateName()
+	}
+
+	scoped := *mw
+	scoped.logger = mw.logger.WithFields(fields)
+	return &scoped
+}
+
+// logLevelHandler reports the level of the logger on GET and changes it on PUT or POST with
+// the level parameter, e.g. curl -X PUT 'localhost:8081/loglevel?level=debug'
+func logLevelHandler(logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			level, err := log.ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid level %q, expected one of panic, fatal, error, warn, info, debug or trace", r.FormValue("level")), http.StatusBadRequest)
+				return
+			}
+			if level != logger.GetLevel() {
+				logger.Warnf("Changing the log level from %s to %s", logger.GetLevel(), level)
+				logger.SetLevel(level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"level": logger.GetLevel().String()})
+	})
+}
@@ -2,30 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 
-	log "github.com/sirupsen/logrus"
-
 	"net/http"
-	"sort"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/innovia/secrets-consumer-webhook/registry"
 	"github.com/innovia/secrets-consumer-webhook/version"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	whhttp "github.com/slok/kubewebhook/pkg/http"
 	"github.com/slok/kubewebhook/pkg/observability/metrics"
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	// "k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -33,15 +40,16 @@ import (
 
 	// kubeVer "k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/kubernetes"
-	kubernetesConfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func (mw *mutatingWebhook) getVolumes(existingVolumes []corev1.Volume, secretManagerConfig secretManagerConfig) []corev1.Volume {
 	mw.logger.Debugf("Adding generic volumes to podspec")
+	gcpServiceAccountKeySecretName, vaultTLSSecretName := secretManagerConfig.volumeSecretNames()
 
 	volumes := []corev1.Volume{
 		{
-			Name: "secrets-consumer-env",
+			Name: secretsConsumerEnvVolume,
 			VolumeSource: corev1.VolumeSource{
 				EmptyDir: &corev1.EmptyDirVolumeSource{
 					Medium: corev1.StorageMediumMemory,
@@ -50,28 +58,28 @@ func (mw *mutatingWebhook) getVolumes(existingVolumes []corev1.Volume, secretMan
 		},
 	}
 
-	if secretManagerConfig.gcp.config.serviceAccountKeySecretName != "" {
+	if gcpServiceAccountKeySecretName != "" {
 		mw.logger.Debugf("Adding Google Cloud Key Volume to podspec")
 		volumes = append(volumes, []corev1.Volume{
 			{
 				Name: "google-cloud-key",
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						SecretName: secretManagerConfig.gcp.config.serviceAccountKeySecretName,
+						SecretName: gcpServiceAccountKeySecretName,
 					},
 				},
 			},
 		}...)
 	}
 
-	if secretManagerConfig.vault.config.tlsSecretName != "" {
+	if vaultTLSSecretName != "" {
 		mw.logger.Debugf("Adding Vault TLS Volume to podspec")
 		volumes = append(volumes, []corev1.Volume{
 			{
 				Name: "vault-tls",
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						SecretName: secretManagerConfig.vault.config.tlsSecretName,
+						SecretName: vaultTLSSecretName,
 					},
 				},
 			},
@@ -85,13 +93,13 @@ func getInitContainers(originalContainers []corev1.Container, secretManagerConfi
 
 	if initContainersMutated || containersMutated {
 		containers = append(containers, corev1.Container{
-			Name:            "copy-secrets-consumer-env",
+			Name:            copySecretsConsumerEnvContainer,
 			Image:           viper.GetString("secrets_consumer_env_image"),
 			ImagePullPolicy: corev1.PullPolicy(viper.GetString("secrets_consumer_env_image_pull_policy")),
 			Command:         []string{"sh", "-c", "cp /usr/local/bin/secrets-consumer-env /secrets-consumer/"},
 			VolumeMounts: []corev1.VolumeMount{
 				{
-					Name:      "secrets-consumer-env",
+					Name:      secretsConsumerEnvVolume,
 					MountPath: "/secrets-consumer/",
 				},
 			},
@@ -107,171 +115,76 @@ func getInitContainers(originalContainers []corev1.Container, secretManagerConfi
 	return containers
 }
 
-func hasSecretPrefix(value string) bool {
-	return strings.HasPrefix(value, "vault:") || strings.HasPrefix(value, ">>secret:") || strings.HasPrefix(value, "secret:")
-}
-
-func (mw *mutatingWebhook) getDataFromConfigmap(cmName string, ns string) (map[string]string, error) {
-	configMap, err := mw.k8sClient.CoreV1().ConfigMaps(ns).Get(cmName, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-	return configMap.Data, nil
-}
+func (mw *mutatingWebhook) mutateContainers(ctx context.Context, containers []corev1.Container, podSpec *corev1.PodSpec, secretManagerConfig secretManagerConfig, ns string) (bool, error) {
+	mutated := false
 
-func (mw *mutatingWebhook) getDataFromSecret(secretName string, ns string) (map[string][]byte, error) {
-	secret, err := mw.k8sClient.CoreV1().Secrets(ns).Get(secretName, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-	return secret.Data, nil
-}
+	for i, container := range containers {
+		var mutationInProgress bool
 
-func (mw *mutatingWebhook) lookForValueFrom(env corev1.EnvVar, ns string) (*corev1.EnvVar, error) {
-	if env.ValueFrom.ConfigMapKeyRef != nil {
-		data, err := mw.getDataFromConfigmap(env.ValueFrom.ConfigMapKeyRef.Name, ns)
-		if err != nil {
-			if apierrors.IsNotFound(err) {
-				return nil, nil
-			}
-			return nil, err
-		}
-		if hasSecretPrefix(data[env.ValueFrom.ConfigMapKeyRef.Key]) {
-			fromCM := corev1.EnvVar{
-				Name:  env.Name,
-				Value: data[env.ValueFrom.ConfigMapKeyRef.Key],
-			}
-			return &fromCM, nil
-		}
-	}
-	if env.ValueFrom.SecretKeyRef != nil {
-		data, err := mw.getDataFromSecret(env.ValueFrom.SecretKeyRef.Name, ns)
-		if err != nil {
-			if apierrors.IsNotFound(err) {
-				return nil, nil
-			}
-			return nil, err
-		}
-		if hasSecretPrefix(string(data[env.ValueFrom.SecretKeyRef.Key])) {
-			fromSecret := corev1.EnvVar{
-				Name:  env.Name,
-				Value: string(data[env.ValueFrom.SecretKeyRef.Key]),
-			}
-			return &fromSecret, nil
+		if isWrapped(container) {
+			mw.logger.Debugf("Container %s already runs with %s", container.Name, secretsConsumerEnvPath)
+			continue
 		}
-	}
-	return nil, nil
-}
 
-func (mw *mutatingWebhook) lookForEnvFrom(envFrom []corev1.EnvFromSource, ns string) ([]corev1.EnvVar, error) {
-	var envVars []corev1.EnvVar
+		if !isContainerSelected(secretManagerConfig, container) {
+			mw.logger.Debugf("Container %s is not selected for secrets injection", container.Name)
+			continue
+		}
 
-	for _, ef := range envFrom {
-		if ef.ConfigMapRef != nil {
-			data, err := mw.getDataFromConfigmap(ef.ConfigMapRef.Name, ns)
-			if err != nil {
-				if apierrors.IsNotFound(err) || (ef.ConfigMapRef.Optional != nil && *ef.ConfigMapRef.Optional) {
-					continue
-				} else {
-					return envVars, err
-				}
-			}
-			for key, value := range data {
-				if hasSecretPrefix(value) {
-					envFromCM := corev1.EnvVar{
-						Name:  key,
-						Value: value,
-					}
-					envVars = append(envVars, envFromCM)
-				}
-			}
+		envVars, err := mw.secretEnvReferences(ctx, container, ns)
+		if err != nil {
+			return false, err
 		}
-		if ef.SecretRef != nil {
-			data, err := mw.getDataFromSecret(ef.SecretRef.Name, ns)
-			if err != nil {
-				if apierrors.IsNotFound(err) || (ef.SecretRef.Optional != nil && *ef.SecretRef.Optional) {
-					continue
-				} else {
-					return envVars, err
-				}
-			}
-			for key, value := range data {
-				if hasSecretPrefix(string(value)) {
-					envFromSec := corev1.EnvVar{
-						Name:  key,
-						Value: string(value),
-					}
-					envVars = append(envVars, envFromSec)
-				}
-			}
+		for _, env := range envVars {
+			mw.logger.Debugf("Container %s references a secret in env var %s", container.Name, env.Name)
 		}
-	}
-	return envVars, nil
-}
 
-func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSpec *corev1.PodSpec, secretManagerConfig secretManagerConfig, ns string) (bool, error) {
-	mutated := false
-	var mutationInProgress bool
-	for i, container := range containers {
-		var envVars []corev1.EnvVar
-		if len(container.EnvFrom) > 0 {
-			envFrom, err := mw.lookForEnvFrom(container.EnvFrom, ns)
-			if err != nil {
-				return false, err
-			}
-			envVars = append(envVars, envFrom...)
-		}
-		for _, env := range container.Env {
-			if hasSecretPrefix(env.Value) {
-				envVars = append(envVars, env)
-			}
-			if env.ValueFrom != nil {
-				valueFrom, err := mw.lookForValueFrom(env, ns)
-				if err != nil {
-					return false, err
-				}
-				if valueFrom == nil {
-					continue
-				}
-				envVars = append(envVars, *valueFrom)
-			}
+		if secretManagerConfig.explicitSecrets && len(envVars) == 0 {
+			mw.logger.Debugf("Container %s references no secrets, skipping", container.Name)
+			continue
 		}
 
 		args := container.Command
 
 		// the container has no explicitly specified command
 		if len(args) == 0 {
-			mw.logger.Info("No command was given - attempting to get image metadata")
-			imageConfig, err := mw.registry.GetImageConfig(mw.k8sClient, ns, &container, podSpec)
-			if err != nil {
-				return false, err
-			}
-
-			args = append(args, imageConfig.Entrypoint...)
-
-			// If no Args are defined we can use the Docker CMD from the image
-			// https://kubernetes.io/docs/tasks/inject-data-application/define-command-argument-container/#notes
-			if len(container.Args) == 0 {
-				args = append(args, imageConfig.Cmd...)
+			imageConfig := imageConfigFor(secretManagerConfig.imageConfigs, container)
+			if _, ok := secretManagerConfig.unresolved[container.Name]; ok {
+				// the wrapper runs the entrypoint of the image with the args, or else its CMD, like the kubelet
+				mw.logger.Warnf("The command of container %s is unknown, the wrapper resolves it from image %s", container.Name, container.Image)
+				container.Env = append(container.Env, corev1.EnvVar{Name: ResolveImageEnvVar, Value: container.Image})
+			} else if imageConfig == nil {
+				mw.logger.Warnf("Not injecting secrets into container %s, its command is unknown", container.Name)
+				continue
+			} else {
+				args = append(args, imageConfig.Entrypoint...)
+
+				// If no Args are defined we can use the Docker CMD from the image
+				// https://kubernetes.io/docs/tasks/inject-data-application/define-command-argument-container/#notes
+				if len(container.Args) == 0 {
+					args = append(args, imageConfig.Cmd...)
+				}
 			}
 		}
 		args = append(args, container.Args...)
 
-		container.Command = []string{"/secrets-consumer/secrets-consumer-env"}
+		container.Command = []string{secretsConsumerEnvPath}
 		container.Args = args
 
-		if secretManagerConfig.aws.config.enabled {
-			container = secretManagerConfig.aws.mutateContainer(container)
+		backends := secretManagerConfig.forContainer(container.Name)
+
+		if backends.aws.config.enabled {
+			container = backends.aws.mutateContainer(container)
 			mutationInProgress = true
 		}
 
-		if secretManagerConfig.gcp.config.enabled {
-			container = secretManagerConfig.gcp.mutateContainer(container)
+		if backends.gcp.config.enabled {
+			container = backends.gcp.mutateContainer(container)
 			mutationInProgress = true
 		}
 
-		if secretManagerConfig.vault.config.enabled {
-			container = secretManagerConfig.vault.mutateContainer(container)
+		if backends.vault.config.enabled {
+			container = backends.vault.mutateContainer(container)
 			mutationInProgress = true
 		}
 
@@ -280,10 +193,17 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 		}
 		mutated = true
 
+		if secretManagerConfig.explicitSecrets {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  ExplicitSecretKeysEnvVar,
+				Value: strings.Join(referencedSecretKeys(envVars), ","),
+			})
+		}
+
 		// add the volume mount for secret-manager-env
 		container.VolumeMounts = append(container.VolumeMounts, []corev1.VolumeMount{
 			{
-				Name:      "secrets-consumer-env",
+				Name:      secretsConsumerEnvVolume,
 				MountPath: "/secrets-consumer",
 			},
 		}...)
@@ -293,12 +213,56 @@ func (mw *mutatingWebhook) mutateContainers(containers []corev1.Container, podSp
 	return mutated, nil
 }
 
-func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, secretManagerConfig secretManagerConfig, ns string, dryRun bool) error {
+func (mw *mutatingWebhook) mutatePod(ctx context.Context, pod *corev1.Pod, secretManagerConfig secretManagerConfig, ns string, dryRun bool) error {
 	mw.logger.Debugf("Successfully connected to the API")
 
-	initContainersMutated, err := mw.mutateContainers(pod.Spec.InitContainers, &pod.Spec, secretManagerConfig, ns)
+	if isPodMutated(pod) {
+		mw.logger.Infof("Pod was already mutated, skipping")
+		return nil
+	}
+
+	// every referenced ConfigMap and Secret is read once for the whole pod
+	ctx = withReferenceCache(ctx)
+
+	if secretManagerConfig.explicitSecrets {
+		// the containers referencing no secrets are left alone, without looking up their image
+		excludeContainers := append([]string{}, secretManagerConfig.excludeContainers...)
+		for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+			envVars, err := mw.secretEnvReferences(ctx, c, ns)
+			if err != nil {
+				return &mutationFailure{reasonReference, err}
+			}
+			if len(envVars) == 0 {
+				excludeContainers = append(excludeContainers, c.Name)
+			}
+		}
+		secretManagerConfig.excludeContainers = excludeContainers
+	}
+
+	imageConfigs, unresolved, err := mw.resolveImageConfigs(ctx, pod, secretManagerConfig, ns)
 	if err != nil {
-		return err
+		return &mutationFailure{reasonImageConfig, err}
+	}
+	secretManagerConfig.imageConfigs = imageConfigs
+	secretManagerConfig.unresolved = unresolved
+
+	// in the order of the containers, the annotation is stable across reinvocations
+	var warnings []string
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if warning, ok := unresolved[c.Name]; ok {
+			warnings = append(warnings, warning)
+		}
+	}
+	if len(warnings) > 0 {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[AnnotationWarning] = strings.Join(warnings, "; ")
+	}
+
+	initContainersMutated, err := mw.mutateContainers(ctx, pod.Spec.InitContainers, &pod.Spec, secretManagerConfig, ns)
+	if err != nil {
+		return &mutationFailure{reasonReference, err}
 	}
 
 	if initContainersMutated {
@@ -307,9 +271,9 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, secretManagerConfig secret
 		mw.logger.Debugf("No pod init containers were mutated")
 	}
 
-	containersMutated, err := mw.mutateContainers(pod.Spec.Containers, &pod.Spec, secretManagerConfig, ns)
+	containersMutated, err := mw.mutateContainers(ctx, pod.Spec.Containers, &pod.Spec, secretManagerConfig, ns)
 	if err != nil {
-		return err
+		return &mutationFailure{reasonReference, err}
 	}
 
 	if containersMutated {
@@ -324,53 +288,56 @@ func (mw *mutatingWebhook) mutatePod(pod *corev1.Pod, secretManagerConfig secret
 
 		pod.Spec.Volumes = append(pod.Spec.Volumes, mw.getVolumes(pod.Spec.Volumes, secretManagerConfig)...)
 		mw.logger.Debugf("Successfully appended pod spec volumes")
+
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[AnnotationStatus] = newInjectionStatus(pod, secretManagerConfig).String()
 	}
 
-	if viper.GetString("secrets_consumer_env_image_pull_secret_name") != "" {
-		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: viper.GetString("secrets_consumer_env_image_pull_secret_name")})
+	if name := viper.GetString("secrets_consumer_env_image_pull_secret_name"); name != "" && !hasImagePullSecret(pod.Spec.ImagePullSecrets, name) {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
 	}
 
+	mw.recordUnresolvedCommands(ctx, pod, warnings)
 	return nil
 }
 
-// take all the annotations (m), filter the prefix(delemiter) "secret-config-" and sort them alpha-numeric
-func filterAndSortMapNumStr(m map[string]string, delimiter string) ([]string, error) {
-	keys := make([]string, 0, len(m))
+// invalidBooleanError reports an invalid boolean annotation with the wording of the schema, so
+// that validatePodConfig reports it once
+func invalidBooleanError(key, value string) error {
+	return fmt.Errorf("annotation %s: invalid boolean %q, use \"true\" or \"false\"", key, value)
+}
 
-	for k := range m {
-		if strings.HasPrefix(k, delimiter) {
-			keys = append(keys, k)
+// parseBackendConfigs reads the secret manager backends settings from the annotations, it returns
+// the invalid boolean values keyed by annotation. They are read as false
+func (mw *mutatingWebhook) parseBackendConfigs(smCfg *secretManagerConfig, annotations map[string]string) map[string]string {
+	invalid := map[string]string{}
+	parseBool := func(key string) bool {
+		value, ok := annotations[key]
+		if !ok {
+			return false
 		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			invalid[key] = value
+		}
+		return b
 	}
 
-	if len(keys) > 0 {
-		sort.Slice(keys, func(i, j int) bool {
-			numA, _ := strconv.Atoi(strings.Split(keys[i], delimiter)[1])
-			numB, _ := strconv.Atoi(strings.SplitAfter(keys[j], delimiter)[1])
-			return numA < numB
-		})
-	}
-
-	return keys, nil
-}
-
-func (mw *mutatingWebhook) parseSecretManagerConfig(obj metav1.Object) secretManagerConfig {
-	var smCfg secretManagerConfig
-	annotations := obj.GetAnnotations()
-
-	smCfg.aws.config.enabled, _ = strconv.ParseBool(annotations[AnnotationAWSSecretManagerEnabled])
+	smCfg.aws.config.enabled = parseBool(AnnotationAWSSecretManagerEnabled)
 	smCfg.aws.config.region = annotations[AnnotationAWSSecretManagerRegion]
 	smCfg.aws.config.roleARN = annotations[AnnotationAWSSecretManagerRoleARN]
 	smCfg.aws.config.secretName = annotations[AnnotationAWSSecretManagerSecretName]
 	smCfg.aws.config.previousVersion = annotations[AnnotationAWSSecretManagerPreviousVersion]
 
-	smCfg.gcp.config.enabled, _ = strconv.ParseBool(annotations[AnnotationGCPSecretManagerEnabled])
+	smCfg.gcp.config.enabled = parseBool(AnnotationGCPSecretManagerEnabled)
 	smCfg.gcp.config.projectID = annotations[AnnotationGCPSecretManagerProjectID]
 	smCfg.gcp.config.secretName = annotations[AnnotationGCPSecretManagerSecretName]
 	smCfg.gcp.config.secretVersion = annotations[AnnotationGCPSecretManagerSecretVersion]
 	smCfg.gcp.config.serviceAccountKeySecretName = annotations[AnnotationGCPSecretManagerGCPServiceAccountKeySecretName]
 
-	smCfg.vault.config.enabled, _ = strconv.ParseBool(annotations[AnnotationVaultEnabled])
+	smCfg.vault.config.enabled = parseBool(AnnotationVaultEnabled)
 	smCfg.vault.config.addr = annotations[AnnotationVaultService]
 	smCfg.vault.config.path = annotations[AnnotationVaultSecretPath]
 	smCfg.vault.config.role = annotations[AnnotationVaultRole]
@@ -379,18 +346,63 @@ func (mw *mutatingWebhook) parseSecretManagerConfig(obj metav1.Object) secretMan
 	smCfg.vault.config.vaultCACert = annotations[AnnotationVaultCACert]
 	smCfg.vault.config.tokenPath = annotations[AnnotationVaultK8sTokenPath]
 	smCfg.vault.config.backend = annotations[AnnotationVaultAuthPath]
-	smCfg.vault.config.useSecretNamesAsKeys, _ = strconv.ParseBool(annotations[AnnotationVaultUseSecretNamesAsKeys])
+	smCfg.vault.config.useSecretNamesAsKeys = parseBool(AnnotationVaultUseSecretNamesAsKeys)
 	smCfg.vault.config.version = annotations[AnnotationVaultSecretVersion]
 	smCfg.vault.config.kubernetesBackend = annotations[AnnotationVaultAuthPath]
-	smCfg.vault.config.secretConfigs = []string{}
-	keys, err := filterAndSortMapNumStr(annotations, AnnotationVaultMultiSecretPrefix)
 
+	var err error
+	smCfg.vault.config.secretConfigs, err = parseVaultSecretConfigs(annotations)
+	if err != nil {
+		mw.logger.Warnf("ignoring invalid %s annotations: %+v", AnnotationVaultMultiSecretPrefix, err)
+	}
+	return invalid
+}
+
+func (mw *mutatingWebhook) parseSecretManagerConfig(obj metav1.Object) secretManagerConfig {
+	var smCfg secretManagerConfig
+	var err error
+	annotations := obj.GetAnnotations()
+
+	invalid := mw.parseBackendConfigs(&smCfg, annotations)
+
+	if value, ok := annotations[AnnotationExplicitSecrets]; ok {
+		smCfg.explicitSecrets, err = strconv.ParseBool(value)
+		if err != nil {
+			invalid[AnnotationExplicitSecrets] = value
+		}
+	}
+
+	smCfg.imageConfigs, err = parseImageConfigs(annotations)
 	if err != nil {
-		mw.logger.Warnf("sorting annotations of %s failed! %+v", AnnotationVaultMultiSecretPrefix, err)
+		mw.logger.Warnf("ignoring invalid annotation %s: %+v", AnnotationImageConfigs, err)
+	}
+
+	// an invalid command is rejected by validate rather than ignored, the containers would run without the intended command
+	smCfg.commandHint, smCfg.commandHints, smCfg.commandHintErr = parseCommandHints(annotations[AnnotationCommand])
+
+	if value, ok := annotations[AnnotationContainers]; ok {
+		smCfg.containers = append([]string{}, parseContainerNames(value)...)
 	}
+	smCfg.excludeContainers = parseContainerNames(annotations[AnnotationExcludeContainers])
 
-	for _, k := range keys {
-		smCfg.vault.config.secretConfigs = append(smCfg.vault.config.secretConfigs, annotations[k])
+	for name, containerAnnotations := range containerScopedAnnotations(annotations) {
+		if smCfg.containerConfigs == nil {
+			smCfg.containerConfigs = map[string]secretManagerConfig{}
+		}
+		containerConfig := secretManagerConfig{}
+		for key, value := range mw.parseBackendConfigs(&containerConfig, containerAnnotations) {
+			// the values inherited from the pod annotations are reported once, for the pod
+			if podValue, ok := annotations[key]; ok && podValue == value {
+				continue
+			}
+			invalid[containerScopedKey(key, name)] = value
+		}
+		smCfg.containerConfigs[name] = containerConfig
+	}
+
+	// reported by validatePod rather than ignored, the backend would silently be disabled
+	for _, key := range sortedKeys(invalid) {
+		smCfg.annotationErrs = append(smCfg.annotationErrs, invalidBooleanError(key, invalid[key]))
 	}
 
 	return smCfg
@@ -399,64 +411,74 @@ func (mw *mutatingWebhook) parseSecretManagerConfig(obj metav1.Object) secretMan
 // SecretsMutator if object is Pod mutate pod specs
 // return a stop boolean to stop executing the chain and also an error.
 func (mw *mutatingWebhook) SecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
+	mw = mw.forRequest(ctx, obj)
+
+	_, span := startSpan(ctx, "admission.parse_config")
 	smCfg := mw.parseSecretManagerConfig(obj)
+	span.SetAttributes(attribute.String("secrets.backends", strings.Join(smCfg.enabledBackends(), ",")))
+	span.End()
 	mw.logger.Debugf("Secret Managers config: %#v", smCfg)
 
 	switch v := obj.(type) {
 	case *corev1.Pod:
-		if smCfg.aws.config.enabled {
-			mw.logger.Infof("Using AWS Secret Manager")
-
-			if smCfg.aws.config.secretName == "" {
-				return true, fmt.Errorf("Error getting aws secret name - make sure you set the annotation %s on the Pod", AnnotationAWSSecretManagerSecretName)
+		start := time.Now()
+		ns := whcontext.GetAdmissionRequest(ctx).Namespace
+		// the outcome is counted, told to the owners of the pod with an Event, and audited
+		// unless the pod was skipped
+		result := func(outcome, reason string, err error) {
+			recordMutation(ns, smCfg, outcome, reason, start)
+			mw.recordEvent(ctx, v, smCfg, outcome, reason, err)
+			if mw.audit != nil && outcome != "skipped" {
+				decision := "mutated"
+				if outcome == "rejected" {
+					decision = "denied"
+				}
+				mw.audit.record(newAuditRecord(ctx, v, smCfg, decision, reason, err))
 			}
+		}
+
+		// misspelled annotations may be the reason no backend is enabled
+		if err := validatePodConfig(v.Annotations, smCfg, &v.Spec); err != nil {
+			result("rejected", reasonInvalidConfig, err)
+			return true, err
+		}
 
-			return false, mw.mutatePod(v, smCfg, whcontext.GetAdmissionRequest(ctx).Namespace, whcontext.IsAdmissionRequestDryRun(ctx))
+		if !smCfg.isEnabled() {
+			result("skipped", reasonNotEnabled, nil)
+			return false, nil
 		}
 
+		if smCfg.aws.config.enabled {
+			mw.logger.Infof("Using AWS Secret Manager")
+		}
 		if smCfg.gcp.config.enabled {
-			var err error
 			mw.logger.Infof("Using GCP Secret Manager")
-
-			if smCfg.gcp.config.projectID == "" {
-				err = fmt.Errorf("Error getting gcp project id - make sure you set the annotation %s on the Pod", AnnotationGCPSecretManagerProjectID)
-			}
-			if smCfg.gcp.config.secretName == "" {
-				err = fmt.Errorf("Error getting gcp secret name - make sure you set the annotation %s on the Pod", AnnotationGCPSecretManagerSecretName)
-			}
-
-			if err != nil {
-				return true, err
-			}
-
-			return false, mw.mutatePod(v, smCfg, whcontext.GetAdmissionRequest(ctx).Namespace, whcontext.IsAdmissionRequestDryRun(ctx))
 		}
-
 		if smCfg.vault.config.enabled {
-			var err error
 			mw.logger.Info("Using Vault Secret Manager")
+		}
 
-			if smCfg.vault.config.addr == "" {
-				err = fmt.Errorf("Error getting vault service address - make sure you set the annotation %s on the Pod", AnnotationVaultEnabled)
-			}
-
-			if smCfg.vault.config.path == "" && len(smCfg.vault.config.secretConfigs) == 0 {
-				err = fmt.Errorf("Error getting vault secret path - make sure you either set the annotation %s or use the annotation %s-x where x is the secret number", AnnotationVaultSecretPath, AnnotationVaultMultiSecretPrefix)
-			}
-
-			if smCfg.vault.config.role == "" {
-				err = fmt.Errorf("Error getting vault role - make sure you set the annotation %s", AnnotationVaultRole)
-			}
-
-			if smCfg.vault.config.tlsSecretName != "" && smCfg.vault.config.vaultCACert == "" {
-				err = fmt.Errorf("Error getting CA cert filename - make sure you set the annotation %s with the CA cert file name", AnnotationVaultCACert)
-			}
-
-			if err != nil {
+		// dry runs do not mint ServiceAccount tokens nor log into Vault
+		if mw.preflight != nil && !whcontext.IsAdmissionRequestDryRun(ctx) {
+			if err := mw.preflightCheck(ctx, v, smCfg, ns); err != nil {
+				result("rejected", failureReason(err), err)
 				return true, err
 			}
+		}
+
+		alreadyMutated := isPodMutated(v)
+		if err := mw.mutatePod(ctx, v, smCfg, ns, whcontext.IsAdmissionRequestDryRun(ctx)); err != nil {
+			result("rejected", failureReason(err), err)
+			return false, err
+		}
 
-			return false, mw.mutatePod(v, smCfg, whcontext.GetAdmissionRequest(ctx).Namespace, whcontext.IsAdmissionRequestDryRun(ctx))
+		switch {
+		case alreadyMutated:
+			result("skipped", reasonAlreadyMutated, nil)
+		case v.Annotations[AnnotationStatus] == "":
+			result("skipped", reasonNoContainers, nil)
+		default:
+			result("mutated", "", nil)
 		}
 		return false, nil
 	default:
@@ -464,23 +486,43 @@ func (mw *mutatingWebhook) SecretsMutator(ctx context.Context, obj metav1.Object
 	}
 }
 
-func healthzHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(200)
+// withAdmissionDeadline bounds the admission with the timeout the API server sends
+// in the request URL (?timeout=10s), minus a safety margin, so that a slow dependency
+// ends up as an explicit denial instead of a webhook call timeout
+func withAdmissionDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+		if err != nil || timeout <= 0 {
+			timeout = viper.GetDuration("admission_default_timeout")
+		}
+
+		timeout -= viper.GetDuration("admission_timeout_margin")
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
-func (mw *mutatingWebhook) serveMetrics(addr string) {
-	mw.logger.Infof("Telemetry on http://%s", addr)
+func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, recorder metrics.Recorder, logger logrus.FieldLogger) http.Handler {
+	webhook, err := mutating.NewWebhook(config, tracedMutator(mutator), nil, recorder, logger)
+	if err != nil {
+		logger.Fatalf("error creating webhook: %s", err)
+	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(addr, mux)
+	handler, err := whhttp.HandlerFor(&tracedWebhook{webhook: webhook})
 	if err != nil {
-		mw.logger.Fatalf("error serving telemetry: %s", err)
+		logger.Fatalf("error creating webhook: %s", err)
 	}
+
+	return handler
 }
 
-func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, recorder metrics.Recorder, logger logrus.FieldLogger) http.Handler {
-	webhook, err := mutating.NewWebhook(config, mutator, nil, recorder, logger)
+func validatingHandlerFor(config validating.WebhookConfig, validator validating.Validator, recorder metrics.Recorder, logger logrus.FieldLogger) http.Handler {
+	webhook, err := validating.NewWebhook(config, validator, nil, recorder, logger)
 	if err != nil {
 		logger.Fatalf("error creating webhook: %s", err)
 	}
@@ -494,7 +536,8 @@ func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, recorde
 }
 
 func newK8SClient() (kubernetes.Interface, error) {
-	kubeConfig, err := kubernetesConfig.GetConfig()
+	// KUBECONFIG or ~/.kube/config out of the cluster, the service account in the cluster
+	kubeConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -508,43 +551,162 @@ func init() {
 	viper.SetDefault("secrets_consumer_env_image_pull_secret_name", "")
 	viper.SetDefault("tls_cert_file", "")
 	viper.SetDefault("tls_private_key_file", "")
+	viper.SetDefault("tls_self_managed", "false")
+	viper.SetDefault("tls_namespace", "")
+	viper.SetDefault("tls_secret_name", "")
+	viper.SetDefault("tls_service_name", "")
+	viper.SetDefault("tls_mutating_webhook_configuration", "")
+	viper.SetDefault("tls_validating_webhook_configuration", "")
+	viper.SetDefault("tls_ca_validity", "87600h")
+	viper.SetDefault("tls_cert_validity", "2160h")
+	viper.SetDefault("tls_rotate_before", "720h")
+	viper.SetDefault("tls_check_interval", "1h")
 	viper.SetDefault("listen_address", ":8443")
+	viper.SetDefault("tls_client_ca_file", "")
+	viper.SetDefault("tls_client_allowed_names", "")
+	viper.SetDefault("server_read_header_timeout", "5s")
+	viper.SetDefault("server_read_timeout", "10s")
+	viper.SetDefault("server_write_timeout", "35s")
+	viper.SetDefault("server_idle_timeout", "2m")
+	viper.SetDefault("server_max_header_bytes", 1<<20)
+	viper.SetDefault("server_max_body_bytes", 6<<20)
+	viper.SetDefault("shutdown_delay", "5s")
+	viper.SetDefault("shutdown_timeout", "20s")
+	viper.SetDefault("readyz_interval", "10s")
+	viper.SetDefault("readyz_check_timeout", "5s")
+	viper.SetDefault("readyz_cert_min_validity", "24h")
+	viper.SetDefault("readyz_env_image_gating", false)
+	viper.SetDefault("webhook_namespace", "default")
 	viper.SetDefault("debug", "false")
 	viper.SetDefault("enable_json_log", "false")
 	viper.SetDefault("telemetry_listen_address", "")
+	viper.SetDefault("registry_skip_verify", "false")
+	viper.SetDefault("registry_mirrors_file", "")
+	viper.SetDefault("registry_timeout", "8s")
+	viper.SetDefault("admission_default_timeout", "10s")
+	viper.SetDefault("admission_timeout_margin", "1s")
+	viper.SetDefault("workload_mutation", "false")
+	viper.SetDefault("workload_validation", "false")
+	viper.SetDefault("image_config_failure_policy", imageConfigFailurePolicyReject)
+	viper.SetDefault("reference_informers", "false")
+	viper.SetDefault("reference_informers_label_selector", "")
+	viper.SetDefault("reference_informers_resync", "10m")
+	viper.SetDefault("reference_retry_steps", 4)
+	viper.SetDefault("mutation_events", "true")
+	viper.SetDefault("audit_sinks", "")
+	viper.SetDefault("audit_file_path", "")
+	viper.SetDefault("audit_file_max_size", 100<<20)
+	viper.SetDefault("audit_file_max_backups", 5)
+	viper.SetDefault("audit_http_url", "")
+	viper.SetDefault("audit_http_headers", "")
+	viper.SetDefault("audit_http_timeout", "5s")
+	viper.SetDefault("audit_http_queue_size", 1000)
+	viper.SetDefault("preflight_check", "false")
+	viper.SetDefault("preflight_timeout", "3s")
+	viper.SetDefault("preflight_cache_ttl", "5m")
+	viper.SetDefault("preflight_failure_cache_ttl", "30s")
+	viper.SetDefault("preflight_failure_policy", preflightFailurePolicyReject)
+	viper.SetDefault("preflight_token_expiration", "10m")
+	viper.SetDefault("preflight_token_audiences", defaultPreflightTokenAudience)
+	viper.SetDefault("preflight_vault_addresses", "")
+	viper.SetDefault("tracing_otlp_endpoint", "")
+	viper.SetDefault("tracing_otlp_headers", "")
+	viper.SetDefault("tracing_otlp_timeout", "10s")
+	viper.SetDefault("tracing_sample_ratio", 1.0)
+	viper.SetDefault("tracing_service_name", "secrets-consumer-webhook")
+	viper.SetDefault("skip_containers", "istio-proxy,istio-init,linkerd-proxy,linkerd-init")
 	viper.AutomaticEnv()
 }
 
 func main() {
-	var logger logrus.FieldLogger
-	{
-		log := logrus.New()
-
-		if viper.GetBool("enable_json_log") {
-			log.SetFormatter(&logrus.JSONFormatter{})
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			os.Exit(renderCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "lint":
+			os.Exit(lintCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
 		}
+	}
 
-		if viper.GetBool("debug") {
-			log.SetLevel(logrus.DebugLevel)
-			log.Debug("Debug mode enabled")
-		}
+	baseLogger := newLogger()
+	logger := baseLogger.WithField("app", "secrets-consumer-webhook")
 
-		logger = log.WithField("app", "secrets-consumer-webhook")
+	if err := validateImageConfigFailurePolicy(viper.GetString("image_config_failure_policy")); err != nil {
+		logger.Fatalf("error in the configuration: %s", err)
+	}
+	if viper.GetBool("preflight_check") {
+		if err := validatePreflightSettings(viper.GetString("preflight_vault_addresses"), viper.GetString("preflight_failure_policy")); err != nil {
+			logger.Fatalf("error in the preflight configuration: %s", err)
+		}
 	}
 	fmt.Printf("Secrets Consumer Webhook Version: %s Commit: %s", version.GetVersion(), version.GetGitCommitID())
 	fmt.Printf("Secrets Consumer Env Version: %s", viper.GetString("secrets_consumer_env_image"))
 
+	var tracerProvider *sdktrace.TracerProvider
+	if endpoint := viper.GetString("tracing_otlp_endpoint"); endpoint != "" {
+		var err error
+		tracerProvider, err = newTracerProvider()
+		if err != nil {
+			logger.Fatalf("error setting up tracing: %s", err)
+		}
+		otel.SetTracerProvider(tracerProvider)
+		logger.Infof("Exporting traces to %s", endpoint)
+	}
+
 	k8sClient, err := newK8SClient()
 	if err != nil {
 		logger.Fatalf("error creating k8s client: %s", err)
 	}
 
+	imageRegistry, err := registry.NewRegistry(logger)
+	if err != nil {
+		logger.Fatalf("error creating image registry: %s", err)
+	}
+
 	mutatingWebhook := mutatingWebhook{
 		k8sClient: k8sClient,
-		registry:  registry.NewRegistry(),
+		registry:  imageRegistry,
 		logger:    logger,
 	}
 
+	if viper.GetBool("reference_informers") {
+		labelSelector := viper.GetString("reference_informers_label_selector")
+		logger.Infof("Starting ConfigMap and Secret informers (label selector: %q)", labelSelector)
+
+		mutatingWebhook.references, err = newReferenceListers(k8sClient, labelSelector, make(chan struct{}))
+		if err != nil {
+			logger.Fatalf("error starting informers: %s", err)
+		}
+	}
+
+	var certs *certManager
+	if viper.GetBool("tls_self_managed") {
+		certs, err = newCertManager(k8sClient, logger)
+		if err != nil {
+			logger.Fatalf("error creating the certificate manager: %s", err)
+		}
+		if err := certs.ensure(); err != nil {
+			logger.Fatalf("error setting up the webhook certificates: %s", err)
+		}
+		go certs.run(make(chan struct{}))
+	}
+
+	if viper.GetString("audit_sinks") != "" {
+		mutatingWebhook.audit, err = newAuditor(logger)
+		if err != nil {
+			logger.Fatalf("error setting up the audit log: %s", err)
+		}
+	}
+
+	if viper.GetBool("mutation_events") {
+		mutatingWebhook.recorder = newEventRecorder(k8sClient, logger)
+	}
+
+	if viper.GetBool("preflight_check") {
+		logger.Infof("Checking the access of the pods to their Vault secrets on admission")
+		mutatingWebhook.preflight = newPreflightChecker(k8sClient, logger)
+	}
+
 	mutator := mutating.MutatorFunc(mutatingWebhook.SecretsMutator)
 
 	metricsRecorder := metrics.NewPrometheus(prometheus.DefaultRegisterer)
@@ -552,30 +714,107 @@ func main() {
 	podHandler := handlerFor(mutating.WebhookConfig{Name: "secrets-consumer-webhook-pods", Obj: &corev1.Pod{}}, mutator, metricsRecorder, logger)
 
 	mux := http.NewServeMux()
-	mux.Handle("/pods", podHandler)
-	mux.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	mux.Handle("/pods", admissionHandler(podHandler))
+
+	if viper.GetBool("workload_mutation") {
+		workloadMutator := mutating.MutatorFunc(mutatingWebhook.WorkloadMutator)
+		for path, obj := range map[string]metav1.Object{
+			"/deployments":  &appsv1.Deployment{},
+			"/statefulsets": &appsv1.StatefulSet{},
+			"/jobs":         &batchv1.Job{},
+			"/cronjobs":     &batchv1beta1.CronJob{},
+		} {
+			name := "secrets-consumer-webhook-" + strings.TrimPrefix(path, "/")
+			mux.Handle(path, admissionHandler(handlerFor(mutating.WebhookConfig{Name: name, Obj: obj}, workloadMutator, metricsRecorder, logger)))
+		}
+	}
+
+	if viper.GetBool("workload_validation") {
+		workloadValidator := validating.ValidatorFunc(mutatingWebhook.WorkloadValidator)
+		for path, obj := range map[string]metav1.Object{
+			"/validate/deployments":  &appsv1.Deployment{},
+			"/validate/statefulsets": &appsv1.StatefulSet{},
+			"/validate/daemonsets":   &appsv1.DaemonSet{},
+			"/validate/jobs":         &batchv1.Job{},
+			"/validate/cronjobs":     &batchv1beta1.CronJob{},
+		} {
+			name := "secrets-consumer-webhook-validate-" + strings.TrimPrefix(path, "/validate/")
+			mux.Handle(path, admissionHandler(validatingHandlerFor(validating.WebhookConfig{Name: name, Obj: obj}, workloadValidator, metricsRecorder, logger)))
+		}
+	}
 
 	telemetryAddress := viper.GetString("telemetry_listen_address")
 	listenAddress := viper.GetString("listen_address")
 	tlsCertFile := viper.GetString("tls_cert_file")
 	tlsPrivateKeyFile := viper.GetString("tls_private_key_file")
 
+	checks := []readinessCheck{apiCheck(k8sClient), envImageCheck(k8sClient, imageRegistry, logger)}
+	if mutatingWebhook.references != nil {
+		checks = append(checks, informersCheck(mutatingWebhook.references))
+	}
+	if certs != nil {
+		checks = append(checks, certificateCheck(func() (*tls.Certificate, error) { return certs.GetCertificate(nil) }))
+	} else if tlsCertFile != "" || tlsPrivateKeyFile != "" {
+		checks = append(checks, certificateCheck(certificateFiles))
+	}
+	ready := newReadiness(checks...)
+	go ready.run(make(chan struct{}))
+
+	mux.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	mux.Handle("/readyz", http.HandlerFunc(ready.readyzHandler))
+
+	errCh := make(chan error, 2)
+	var servers []*http.Server
+
 	if len(telemetryAddress) > 0 {
 		// Serving metrics without TLS on separated address
-		go mutatingWebhook.serveMetrics(telemetryAddress)
+		telemetryMux := http.NewServeMux()
+		handleTelemetry(telemetryMux, baseLogger)
+		telemetry := newHTTPServer(telemetryAddress, telemetryMux)
+		servers = append(servers, telemetry)
+
+		logger.Infof("Telemetry on http://%s", telemetryAddress)
+		go func() { errCh <- telemetry.ListenAndServe() }()
 	} else {
-		mux.Handle("/metrics", promhttp.Handler())
+		handleTelemetry(mux, baseLogger)
 	}
 
-	if tlsCertFile == "" && tlsPrivateKeyFile == "" {
+	server := newHTTPServer(listenAddress, mux)
+	servers = append(servers, server)
+	if server.TLSConfig, err = newTLSConfig(); err != nil {
+		logger.Fatalf("error configuring TLS: %s", err)
+	}
+
+	switch {
+	case certs != nil:
+		logger.Infof("Listening on https://%s with self-managed certificates", listenAddress)
+		server.TLSConfig.GetCertificate = certs.GetCertificate
+		go func() { errCh <- server.ListenAndServeTLS("", "") }()
+	case tlsCertFile == "" && tlsPrivateKeyFile == "":
+		if viper.GetString("tls_client_ca_file") != "" {
+			logger.Fatalf("client certificates can only be verified with TLS")
+		}
 		logger.Infof("Listening on http://%s", listenAddress)
-		err = http.ListenAndServe(listenAddress, mux)
-	} else {
+		go func() { errCh <- server.ListenAndServe() }()
+	default:
 		logger.Infof("Listening on https://%s", listenAddress)
-		err = http.ListenAndServeTLS(listenAddress, tlsCertFile, tlsPrivateKeyFile, mux)
+		go func() { errCh <- server.ListenAndServeTLS(tlsCertFile, tlsPrivateKeyFile) }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	err = shutdownOnSignal(signals, errCh, ready, mutatingWebhook.audit, logger, servers...)
+
+	if tracerProvider != nil {
+		// export the spans of the last admissions
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("tracing_otlp_timeout"))
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Warnf("error exporting the last traces: %s", err)
+		}
+		cancel()
 	}
 
 	if err != nil {
-		log.Fatalf("error serving webhook: %s", err)
+		logger.Fatalf("error serving webhook: %s", err)
 	}
 }
@@ -1,12 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	cmp "github.com/google/go-cmp/cmp"
+	"github.com/innovia/secrets-consumer-webhook/version"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	fake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 func getSecretManagerConfig(secretManager string) secretManagerConfig {
@@ -429,9 +468,10 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mw := &mutatingWebhook{
 				k8sClient: tt.fields.k8sClient,
+				logger:    logrus.New(),
 			}
 			// t.Logf("args: %+v", tt.args)
-			got, err := mw.mutateContainers(tt.args.containers, tt.args.podSpec, tt.args.secretManagerConfig, tt.args.ns)
+			got, err := mw.mutateContainers(context.Background(), tt.args.containers, tt.args.podSpec, tt.args.secretManagerConfig, tt.args.ns)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("mutatingWebhook.mutateContainers() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -445,3 +485,2274 @@ func Test_mutatingWebhook_mutateContainers(t *testing.T) {
 		})
 	}
 }
+
+type fakeImageRegistry struct {
+	mu       sync.Mutex
+	lookups  []string
+	policies []corev1.PullPolicy
+	delay    time.Duration
+	configs  map[string]*imagev1.ImageConfig
+}
+
+func (r *fakeImageRegistry) GetImageConfig(ctx context.Context, logger logrus.FieldLogger, _ kubernetes.Interface, _ string, container *corev1.Container, _ *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	logger.Infof("Getting the image config of %s", container.Image)
+	r.mu.Lock()
+	r.lookups = append(r.lookups, container.Image)
+	r.policies = append(r.policies, container.ImagePullPolicy)
+	r.mu.Unlock()
+
+	select {
+	case <-time.After(r.delay):
+		if config, ok := r.configs[container.Image]; ok {
+			return config, nil
+		}
+		return nil, fmt.Errorf("manifest unknown")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func Test_mutatingWebhook_getImageConfigs(t *testing.T) {
+	containers := []corev1.Container{
+		{Name: "app", Image: "app:1.0"},
+		{Name: "explicit", Image: "explicit:1.0", Command: []string{"/bin/sh"}},
+		{Name: "worker", Image: "worker:1.0"},
+	}
+	configs := map[string]*imagev1.ImageConfig{
+		"app:1.0":    {Entrypoint: []string{"/app"}},
+		"worker:1.0": {Entrypoint: []string{"/worker"}},
+	}
+
+	t.Run("looks up containers without a command in parallel", func(t *testing.T) {
+		reg := &fakeImageRegistry{delay: 200 * time.Millisecond, configs: configs}
+		mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+		start := time.Now()
+		got, errs := mw.getImageConfigs(context.Background(), containers, &corev1.PodSpec{}, "default", secretManagerConfig{})
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+			t.Errorf("lookups were not run in parallel, took %s", elapsed)
+		}
+		if len(reg.lookups) != 2 {
+			t.Errorf("expected 2 lookups, got %v", reg.lookups)
+		}
+		if !cmp.Equal(got, []*imagev1.ImageConfig{configs["app:1.0"], nil, configs["worker:1.0"]}) {
+			t.Errorf("unexpected image configs %v", got)
+		}
+	})
+
+	t.Run("fails before the admission deadline", func(t *testing.T) {
+		reg := &fakeImageRegistry{delay: time.Minute, configs: configs}
+		mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, errs := mw.getImageConfigs(ctx, containers, &corev1.PodSpec{}, "default", secretManagerConfig{})
+		if errs[0] == nil || !strings.Contains(errs[0].Error(), "container app") {
+			t.Errorf("expected an error naming the container, got %v", errs[0])
+		}
+	})
+
+	t.Run("uses the command hints", func(t *testing.T) {
+		reg := &fakeImageRegistry{configs: configs}
+		mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+		var smCfg secretManagerConfig
+		smCfg.commandHint = []string{"/default"}
+		smCfg.commandHints = map[string][]string{"worker": {"/worker", "run"}}
+
+		got, _ := mw.getImageConfigs(context.Background(), containers, &corev1.PodSpec{}, "default", smCfg)
+		if len(reg.lookups) != 0 {
+			t.Errorf("expected no registry lookups, got %v", reg.lookups)
+		}
+		if !cmp.Equal(got, []*imagev1.ImageConfig{{Entrypoint: []string{"/default"}}, nil, {Entrypoint: []string{"/worker", "run"}}}) {
+			t.Errorf("unexpected image configs %v", got)
+		}
+	})
+}
+
+func Test_mutatingWebhook_resolveImageConfigs(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app:1.0"},
+				{Name: "unreachable", Image: "unreachable:1.0"},
+			},
+		},
+	}
+	reg := &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+	t.Run("rejects by default", func(t *testing.T) {
+		viper.Set("image_config_failure_policy", imageConfigFailurePolicyReject)
+		_, _, err := mw.resolveImageConfigs(context.Background(), pod, secretManagerConfig{}, "default")
+		if err == nil || !strings.Contains(err.Error(), "container unreachable from image unreachable:1.0") {
+			t.Errorf("expected a precise error, got %v", err)
+		}
+	})
+
+	t.Run("admits with a warning", func(t *testing.T) {
+		viper.Set("image_config_failure_policy", imageConfigFailurePolicyAdmitWithWarning)
+		defer viper.Set("image_config_failure_policy", imageConfigFailurePolicyReject)
+
+		imageConfigs, unresolved, err := mw.resolveImageConfigs(context.Background(), pod, secretManagerConfig{}, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(unresolved) != 1 || !strings.Contains(unresolved["unreachable"], "container unreachable") {
+			t.Errorf("unexpected warnings %v", unresolved)
+		}
+		if _, ok := imageConfigs["unreachable"]; ok || imageConfigs["app"].Image != "app:1.0" {
+			t.Errorf("unexpected image configs %v", imageConfigs)
+		}
+	})
+
+	t.Run("wraps the containers with an unknown command", func(t *testing.T) {
+		viper.Set("image_config_failure_policy", imageConfigFailurePolicyAdmitWithWarning)
+		defer viper.Set("image_config_failure_policy", imageConfigFailurePolicyReject)
+
+		pod := pod.DeepCopy()
+		pod.Spec.Containers[1].Args = []string{"--port", "8080"}
+		if err := mw.mutatePod(context.Background(), pod, getSecretManagerConfig("vault-k8s"), "default", false); err != nil {
+			t.Fatal(err)
+		}
+
+		// the wrapper runs the entrypoint it resolves with the args after --
+		unreachable := pod.Spec.Containers[1]
+		if !isWrapped(unreachable) || !strings.HasSuffix(strings.Join(unreachable.Args, " "), " -- --port 8080") {
+			t.Errorf("expected the container to be wrapped with its args, got %v %v", unreachable.Command, unreachable.Args)
+		}
+		if !cmp.Equal(unreachable.Env[0], corev1.EnvVar{Name: ResolveImageEnvVar, Value: "unreachable:1.0"}) {
+			t.Errorf("expected the wrapper to resolve the image, got %v", unreachable.Env)
+		}
+		if !strings.Contains(pod.Annotations[AnnotationWarning], "container unreachable") {
+			t.Errorf("unexpected warning annotation %q", pod.Annotations[AnnotationWarning])
+		}
+	})
+}
+
+func Test_validateImageConfigFailurePolicy(t *testing.T) {
+	for _, policy := range []string{imageConfigFailurePolicyReject, imageConfigFailurePolicyAdmitWithWarning} {
+		if err := validateImageConfigFailurePolicy(policy); err != nil {
+			t.Errorf("validateImageConfigFailurePolicy(%q) error = %v", policy, err)
+		}
+	}
+
+	want := `invalid image_config_failure_policy "admit", use "reject" or "admit-with-warning"`
+	if err := validateImageConfigFailurePolicy("admit"); err == nil || err.Error() != want {
+		t.Errorf("validateImageConfigFailurePolicy() error = %v, want %q", err, want)
+	}
+}
+
+func Test_mutatingWebhook_WorkloadMutator(t *testing.T) {
+	reg := &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{
+		"app:1.0": {Entrypoint: []string{"/app"}, Cmd: []string{"serve"}},
+	}}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						AnnotationVaultEnabled:    "true",
+						AnnotationImageConfigs:    `{"stale": {"image": "stale:1.0"}}`,
+						AnnotationVaultService:    "https://vault:8200",
+						AnnotationVaultSecretPath: "secret/app",
+						AnnotationVaultRole:       "app",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "app:1.0"},
+						{Name: "latest", Image: "app:latest"},
+						{Name: "explicit", Image: "app:1.0", Command: []string{"/bin/sh"}},
+					},
+				},
+			},
+		},
+	}
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Namespace: "default"})
+	if _, err := mw.WorkloadMutator(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"app":{"image":"app:1.0","entrypoint":["/app"],"cmd":["serve"]}}`
+	if got := deployment.Spec.Template.Annotations[AnnotationImageConfigs]; got != want {
+		t.Errorf("annotation %s = %s, want %s", AnnotationImageConfigs, got, want)
+	}
+
+	// a pod created from the template does not need a registry lookup
+	reg.lookups = nil
+	smCfg := mw.parseSecretManagerConfig(&deployment.Spec.Template.ObjectMeta)
+	containers := []corev1.Container{{Name: "app", Image: "app:1.0"}}
+	if _, err := mw.mutateContainers(context.Background(), containers, &deployment.Spec.Template.Spec, smCfg, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.lookups) != 0 {
+		t.Errorf("expected no registry lookups, got %v", reg.lookups)
+	}
+	if !cmp.Equal(containers[0].Args[len(containers[0].Args)-2:], []string{"/app", "serve"}) {
+		t.Errorf("unexpected container args %v", containers[0].Args)
+	}
+
+	// a registry failure keeps the entries of the unchanged images, so it does not trigger a rollout
+	deployment.Spec.Template.Annotations[AnnotationImageConfigs] = `{"app":{"image":"app:2.0","entrypoint":["/app"]},"worker":{"image":"worker:1.0","entrypoint":["/worker"]}}`
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "app", Image: "app:2.0"}, {Name: "worker", Image: "worker:2.0"}}
+	if _, err := mw.WorkloadMutator(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"app":{"image":"app:2.0","entrypoint":["/app"]}}`
+	if got := deployment.Spec.Template.Annotations[AnnotationImageConfigs]; got != want {
+		t.Errorf("annotation %s = %s, want %s", AnnotationImageConfigs, got, want)
+	}
+}
+
+func Test_mutatingWebhook_referenceReads(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default"},
+		Data:       map[string]string{"API_KEY": "vault:API_KEY", "DB_PASSWORD": "vault:DB_PASSWORD"},
+	}
+
+	var env []corev1.EnvVar
+	for i := 0; i < 30; i++ {
+		env = append(env, corev1.EnvVar{
+			Name: fmt.Sprintf("VAR_%d", i),
+			ValueFrom: &corev1.EnvVarSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"},
+					Key:                  "API_KEY",
+				},
+			},
+		})
+	}
+
+	t.Run("reads each referenced object once per admission", func(t *testing.T) {
+		client := fake.NewSimpleClientset(configMap)
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+
+		ctx := withReferenceCache(context.Background())
+		for _, e := range env {
+			if _, err := mw.lookForValueFrom(ctx, e, "default"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := mw.lookForEnvFrom(ctx, []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}}}, "default"); err != nil {
+			t.Fatal(err)
+		}
+
+		if actions := client.Actions(); len(actions) != 1 {
+			t.Errorf("expected a single API call, got %d", len(actions))
+		}
+	})
+
+	t.Run("retries transient API errors", func(t *testing.T) {
+		client := fake.NewSimpleClientset(configMap)
+		failures := 2
+		client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if failures > 0 {
+				failures--
+				return true, nil, apierrors.NewServiceUnavailable("etcd is sad")
+			}
+			return false, nil, nil
+		})
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+
+		got, err := mw.lookForValueFrom(context.Background(), env[0], "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.Value != "vault:API_KEY" {
+			t.Errorf("unexpected env var %v", got)
+		}
+	})
+
+	t.Run("reads the object once without retries", func(t *testing.T) {
+		viper.Set("reference_retry_steps", 0)
+		defer viper.Set("reference_retry_steps", 4)
+
+		client := fake.NewSimpleClientset(configMap)
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+
+		got, err := mw.lookForValueFrom(context.Background(), env[0], "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.Value != "vault:API_KEY" {
+			t.Errorf("unexpected env var %v", got)
+		}
+	})
+
+	t.Run("stops retrying at the admission deadline", func(t *testing.T) {
+		client := fake.NewSimpleClientset(configMap)
+		client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewServiceUnavailable("etcd is sad")
+		})
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := mw.lookForValueFrom(ctx, env[0], "default"); err == nil {
+			t.Error("expected the transient error")
+		}
+		if actions := client.Actions(); len(actions) != 1 {
+			t.Errorf("expected a single API call, got %d", len(actions))
+		}
+	})
+
+	t.Run("does not retry missing objects", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+
+		if _, err := mw.lookForValueFrom(context.Background(), env[0], "default"); err != nil {
+			t.Fatal(err)
+		}
+		if actions := client.Actions(); len(actions) != 1 {
+			t.Errorf("expected a single API call, got %d", len(actions))
+		}
+	})
+}
+
+func Test_mutatingWebhook_secretEnvReferences(t *testing.T) {
+	optional := true
+	objects := []runtime.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Data:       map[string]string{"TOKEN": "vault:first#TOKEN", "PLAIN": "plain", "1INVALID": "vault:invalid", "BAD NAME": "vault:bad"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "second", Namespace: "default"},
+			Data:       map[string]string{"TOKEN": "vault:second#TOKEN", "PLAIN": "vault:second#PLAIN"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"},
+			Data:       map[string][]byte{"PASSWORD": []byte("secret:creds#PASSWORD"), "USER": []byte("admin")},
+		},
+	}
+
+	configMapRef := func(name, prefix string, optional *bool) corev1.EnvFromSource {
+		return corev1.EnvFromSource{Prefix: prefix, ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Optional: optional}}
+	}
+	secretKeyRef := func(name, key string, optional *bool) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key, Optional: optional}}
+	}
+
+	tests := []struct {
+		name      string
+		container corev1.Container
+		want      []corev1.EnvVar
+	}{
+		{
+			name: "later envFrom sources win",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				configMapRef("first", "", nil),
+				configMapRef("second", "", nil),
+			}},
+			want: []corev1.EnvVar{
+				{Name: "PLAIN", Value: "vault:second#PLAIN"},
+				{Name: "TOKEN", Value: "vault:second#TOKEN"},
+			},
+		},
+		{
+			name: "prefixes apply and invalid names are skipped",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				configMapRef("first", "APP_", nil),
+				{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "creds"}}},
+			}},
+			want: []corev1.EnvVar{
+				{Name: "APP_1INVALID", Value: "vault:invalid"},
+				{Name: "APP_TOKEN", Value: "vault:first#TOKEN"},
+				{Name: "PASSWORD", Value: "secret:creds#PASSWORD"},
+			},
+		},
+		{
+			name: "missing sources are skipped",
+			container: corev1.Container{EnvFrom: []corev1.EnvFromSource{
+				configMapRef("missing", "", &optional),
+				configMapRef("missing-required", "", nil),
+				configMapRef("second", "", nil),
+			}},
+			want: []corev1.EnvVar{
+				{Name: "PLAIN", Value: "vault:second#PLAIN"},
+				{Name: "TOKEN", Value: "vault:second#TOKEN"},
+			},
+		},
+		{
+			name: "env overrides envFrom and the last duplicate wins",
+			container: corev1.Container{
+				EnvFrom: []corev1.EnvFromSource{configMapRef("second", "", nil)},
+				Env: []corev1.EnvVar{
+					{Name: "TOKEN", Value: "literal"},
+					{Name: "DB", Value: "vault:db#PASSWORD"},
+					{Name: "DB", Value: "vault:db#OVERRIDE"},
+					{Name: "PLAIN", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+				},
+			},
+			want: []corev1.EnvVar{
+				{Name: "DB", Value: "vault:db#OVERRIDE"},
+			},
+		},
+		{
+			name: "unresolved optional keys do not override",
+			container: corev1.Container{
+				Env: []corev1.EnvVar{
+					{Name: "PASSWORD", Value: "vault:db#PASSWORD"},
+					{Name: "PASSWORD", ValueFrom: secretKeyRef("creds", "MISSING", &optional)},
+					{Name: "USER", Value: "vault:db#USER"},
+					{Name: "USER", ValueFrom: secretKeyRef("missing", "USER", &optional)},
+					{Name: "CREDS", ValueFrom: secretKeyRef("creds", "PASSWORD", nil)},
+				},
+			},
+			want: []corev1.EnvVar{
+				{Name: "CREDS", Value: "secret:creds#PASSWORD"},
+				{Name: "PASSWORD", Value: "vault:db#PASSWORD"},
+				{Name: "USER", Value: "vault:db#USER"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(objects...), logger: logrus.New()}
+
+			got, err := mw.secretEnvReferences(context.Background(), tt.container, "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mutatingWebhook.secretEnvReferences() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_mutatePodIdempotent(t *testing.T) {
+	viper.Set("secrets_consumer_env_image_pull_secret_name", "registry-creds")
+	defer viper.Set("secrets_consumer_env_image_pull_secret_name", "")
+
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: &fakeImageRegistry{}, logger: logrus.New()}
+	smCfg := getSecretManagerConfig("vault-k8s")
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate", Image: "app", Command: []string{"/migrate"}}},
+			Containers:     []corev1.Container{{Name: "app", Image: "app", Command: []string{"/app"}, Args: []string{"serve"}}},
+		},
+	}
+
+	if err := mw.mutatePod(context.Background(), pod, smCfg, "default", false); err != nil {
+		t.Fatal(err)
+	}
+	mutated := pod.DeepCopy()
+
+	var status injectionStatus
+	if err := json.Unmarshal([]byte(pod.Annotations[AnnotationStatus]), &status); err != nil {
+		t.Fatalf("invalid status annotation: %s", err)
+	}
+	wantStatus := injectionStatus{Version: version.GetVersion(), Backends: []string{"vault"}, InitContainers: []string{"migrate"}, Containers: []string{"app"}}
+	if diff := cmp.Diff(wantStatus, status); diff != "" {
+		t.Errorf("status annotation mismatch (-want +got):\n%s", diff)
+	}
+
+	// a reinvocation must leave the pod as it is
+	if err := mw.mutatePod(context.Background(), pod, smCfg, "default", false); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(mutated, pod); diff != "" {
+		t.Errorf("second mutation changed the pod (-first +second):\n%s", diff)
+	}
+
+	// containers already running with the wrapper are not wrapped again
+	containers := []corev1.Container{pod.Spec.Containers[0]}
+	if _, err := mw.mutateContainers(context.Background(), containers, &pod.Spec, smCfg, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(pod.Spec.Containers[0], containers[0]); diff != "" {
+		t.Errorf("wrapped container changed (-want +got):\n%s", diff)
+	}
+}
+
+func Test_mutatingWebhook_containerSelection(t *testing.T) {
+	configs := map[string]*imagev1.ImageConfig{
+		"app:1.0":     {Entrypoint: []string{"/app"}},
+		"migrate:1.0": {Entrypoint: []string{"/migrate"}},
+		"proxy:1.0":   {Entrypoint: []string{"/proxy"}},
+	}
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate", Image: "migrate:1.0"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app:1.0"},
+				{Name: "istio-proxy", Image: "proxy:1.0"},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantWrapped []string
+	}{
+		{
+			name:        "cluster-wide sidecars are skipped",
+			wantWrapped: []string{"migrate", "app"},
+		},
+		{
+			name:        "only the listed containers",
+			annotations: map[string]string{AnnotationContainers: "app, istio-proxy"},
+			wantWrapped: []string{"app", "istio-proxy"},
+		},
+		{
+			name:        "excluded containers",
+			annotations: map[string]string{AnnotationExcludeContainers: "migrate"},
+			wantWrapped: []string{"app"},
+		},
+		{
+			name:        "exclusion wins over inclusion",
+			annotations: map[string]string{AnnotationContainers: "app,migrate", AnnotationExcludeContainers: "app"},
+			wantWrapped: []string{"migrate"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &fakeImageRegistry{configs: configs}
+			mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: reg, logger: logrus.New()}
+
+			smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: tt.annotations})
+			smCfg.vault = getSecretManagerConfig("vault-k8s").vault
+
+			pod := newPod()
+			if err := mw.mutatePod(context.Background(), pod, smCfg, "default", false); err != nil {
+				t.Fatal(err)
+			}
+
+			var wrapped []string
+			for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+				if isWrapped(c) {
+					wrapped = append(wrapped, c.Name)
+				}
+			}
+			if diff := cmp.Diff(tt.wantWrapped, wrapped); diff != "" {
+				t.Errorf("wrapped containers mismatch (-want +got):\n%s", diff)
+			}
+			if len(reg.lookups) != len(tt.wantWrapped) {
+				t.Errorf("expected %d registry lookups, got %v", len(tt.wantWrapped), reg.lookups)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_containerScopedConfig(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), registry: &fakeImageRegistry{}, logger: logrus.New()}
+	annotations := map[string]string{
+		AnnotationVaultEnabled:                                   "true",
+		AnnotationVaultService:                                   "https://vault:8200",
+		AnnotationVaultRole:                                      "app",
+		AnnotationVaultSecretPath:                                "/db/readonly",
+		"vault.secret.manager/secret-config-1":                   `{"path": "/shared"}`,
+		"vault.secret.manager/container.migrate.role":            "migrate",
+		"vault.secret.manager/container.migrate.path":            "/db/admin",
+		"vault.secret.manager/container.migrate.secret-config-1": `{"path": "/migrations"}`,
+		"aws.secret.manager/container.worker.enabled":            "true",
+		"aws.secret.manager/container.worker.region":             "us-east-1",
+		"aws.secret.manager/container.worker.secret-name":        "worker",
+		"vault.secret.manager/container.worker.enabled":          "false",
+	}
+
+	smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: annotations})
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "migrate", Command: []string{"/migrate"}}},
+		Containers: []corev1.Container{
+			{Name: "app", Command: []string{"/app"}},
+			{Name: "worker", Command: []string{"/worker"}},
+		},
+	}}
+	if err := smCfg.validatePod(&pod.Spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.mutatePod(context.Background(), pod, smCfg, "default", false); err != nil {
+		t.Fatal(err)
+	}
+
+	wantArgs := map[string][]string{
+		"migrate": {"vault", "--role=migrate", `--secret-config={"path":"/migrations"}`, "--path=/db/admin", "--", "/migrate"},
+		"app":     {"vault", "--role=app", `--secret-config={"path":"/shared"}`, "--path=/db/readonly", "--", "/app"},
+		"worker":  {"aws", "--region=us-east-1", "--secret-name=worker", "--previous-version=", "--", "/worker"},
+	}
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers[1:]...), pod.Spec.Containers...) {
+		if diff := cmp.Diff(wantArgs[c.Name], c.Args); diff != "" {
+			t.Errorf("container %s args mismatch (-want +got):\n%s", c.Name, diff)
+		}
+	}
+
+	var status injectionStatus
+	if err := json.Unmarshal([]byte(pod.Annotations[AnnotationStatus]), &status); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"aws", "vault"}, status.Backends); diff != "" {
+		t.Errorf("status backends mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("containers must share the volume secrets", func(t *testing.T) {
+		annotations := map[string]string{
+			AnnotationVaultEnabled:                              "true",
+			AnnotationVaultService:                              "https://vault:8200",
+			AnnotationVaultRole:                                 "app",
+			AnnotationVaultSecretPath:                           "/db/readonly",
+			AnnotationVaultTLSSecret:                            "vault-tls",
+			AnnotationVaultCACert:                               "ca.pem",
+			"vault.secret.manager/container.migrate.tls-secret": "other-tls",
+		}
+		smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: annotations})
+		if err := smCfg.validatePod(&pod.Spec); err == nil {
+			t.Error("expected conflicting TLS secrets to be rejected")
+		}
+	})
+
+	t.Run("container scoped settings are validated", func(t *testing.T) {
+		annotations := map[string]string{"vault.secret.manager/container.migrate.enabled": "true"}
+		smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: annotations})
+		err := smCfg.validatePod(&corev1.PodSpec{Containers: []corev1.Container{{Name: "migrate"}, {Name: "app"}}})
+		if err == nil || !strings.HasPrefix(err.Error(), "container migrate:") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func Test_mutatingWebhook_explicitSecrets(t *testing.T) {
+	reg := &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}}
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "refs", Namespace: "default"},
+		Data:       map[string]string{"API_KEY": "secret:API_KEY"},
+	})
+	mw := &mutatingWebhook{k8sClient: client, registry: reg, logger: logrus.New()}
+
+	smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: map[string]string{AnnotationExplicitSecrets: "true"}})
+	smCfg.vault = getSecretManagerConfig("vault-k8s").vault
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name:    "app",
+				Image:   "app:1.0",
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "refs"}}}},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASSWORD", Value: "vault:DB_PASSWORD"},
+					{Name: "DB_USER", Value: "vault:DB_USER"},
+					{Name: "DB_ADMIN", Value: "vault:DB_USER"},
+					{Name: "LOG_LEVEL", Value: "debug"},
+				},
+			},
+			{Name: "metrics", Image: "metrics:1.0"},
+		},
+	}}
+
+	if err := mw.mutatePod(context.Background(), pod, smCfg, "default", false); err != nil {
+		t.Fatal(err)
+	}
+
+	app, metrics := pod.Spec.Containers[0], pod.Spec.Containers[1]
+	if !isWrapped(app) {
+		t.Errorf("expected container app to be wrapped")
+	}
+	if isWrapped(metrics) || len(metrics.Env) > 0 {
+		t.Errorf("expected container metrics to be left alone, got %+v", metrics)
+	}
+	if diff := cmp.Diff([]string{"app:1.0"}, reg.lookups); diff != "" {
+		t.Errorf("registry lookups mismatch (-want +got):\n%s", diff)
+	}
+
+	var allowed string
+	for _, env := range app.Env {
+		if env.Name == ExplicitSecretKeysEnvVar {
+			allowed = env.Value
+		}
+	}
+	if allowed != "API_KEY,DB_PASSWORD,DB_USER" {
+		t.Errorf("unexpected allowed keys %q", allowed)
+	}
+}
+
+func Test_mutatingWebhook_invalidCommandHints(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+
+	for value, want := range map[string]string{
+		`[]`:           "annotation secrets-consumer/command: the command is empty",
+		`{"app": []}`:  "annotation secrets-consumer/command: the command of container app is empty",
+		`"/app serve"`: `annotation secrets-consumer/command: expected a JSON array like ["/app", "serve"] or an object of arrays keyed by container name: json: cannot unmarshal string into Go value of type map[string][]string`,
+	} {
+		annotations := map[string]string{AnnotationCommand: value, "vault.secret.manager/container.app.enabled": "true"}
+		smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: annotations})
+		smCfg.containerConfigs["app"] = getSecretManagerConfig("vault-k8s")
+
+		// reported once even when every container has its own settings
+		if err := smCfg.validatePod(&corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}); err == nil || err.Error() != want {
+			t.Errorf("validatePod() error = %v, want %q", err, want)
+		}
+	}
+}
+
+func Test_mutatingWebhook_invalidBooleans(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+
+	annotations := map[string]string{
+		AnnotationVaultEnabled:                             "true",
+		AnnotationVaultService:                             "https://vault:8200",
+		AnnotationVaultSecretPath:                          "secret/app",
+		AnnotationVaultRole:                                "app",
+		AnnotationVaultUseSecretNamesAsKeys:                "yes",
+		"vault.secret.manager/container.worker.enabled":    "on",
+		"vault.secret.manager/container.migrate.role":      "migrate",
+		"aws.secret.manager/container.migrate.secret-name": "app",
+	}
+	want := []string{
+		`annotation vault.secret.manager/container.worker.enabled: invalid boolean "on", use "true" or "false"`,
+		`annotation vault.secret.manager/use-secret-names-as-keys: invalid boolean "yes", use "true" or "false"`,
+	}
+
+	// the pod value inherited by the container scopes is reported once
+	smCfg := mw.parseSecretManagerConfig(&metav1.ObjectMeta{Annotations: annotations})
+	var got []string
+	for _, err := range smCfg.annotationErrs {
+		got = append(got, err.Error())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("annotationErrs mismatch (-want +got):\n%s", diff)
+	}
+
+	// and once more by the schema pass
+	podSpec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "worker"}, {Name: "migrate"}}}
+	err := validatePodConfig(annotations, smCfg, podSpec)
+	got = nil
+	if agg, ok := err.(utilerrors.Aggregate); ok {
+		for _, err := range agg.Errors() {
+			got = append(got, err.Error())
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("validatePodConfig() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_validateAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErrs    []string
+	}{
+		{
+			name: "valid annotations",
+			annotations: map[string]string{
+				AnnotationVaultEnabled:                        "true",
+				AnnotationVaultRole:                           "app",
+				"vault.secret.manager/secret-config-1":        `{"path": "secret/app"}`,
+				"vault.secret.manager/container.migrate.role": "migrate",
+				AnnotationExplicitSecrets:                     "false",
+				AnnotationCommand:                             `["/app"]`,
+				"app.kubernetes.io/name":                      "app",
+			},
+		},
+		{
+			name: "every error is reported",
+			annotations: map[string]string{
+				AnnotationVaultEnabled:            "yes",
+				"vault.secret.manager/vault-role": "app",
+				"vvault.secret.manager/path":      "secret/app",
+				AnnotationCommand:                 `[`,
+			},
+			wantErrs: []string{
+				`annotation secrets-consumer/command: invalid JSON "["`,
+				`annotation vault.secret.manager/enabled: invalid boolean "yes", use "true" or "false"`,
+				`unknown annotation vault.secret.manager/vault-role, did you mean vault.secret.manager/role?`,
+				`unknown annotation vvault.secret.manager/path, did you mean vault.secret.manager/path?`,
+			},
+		},
+		{
+			name: "container scoped annotations",
+			annotations: map[string]string{
+				"vault.secret.manager/container.migrate.rol": "migrate",
+				"secrets-consumer/container.migrate.command": `["/migrate"]`,
+			},
+			wantErrs: []string{
+				`unknown annotation secrets-consumer/container.migrate.command`,
+				`unknown annotation vault.secret.manager/container.migrate.rol, did you mean vault.secret.manager/container.migrate.role?`,
+			},
+		},
+		{
+			name:        "unsupported schema version",
+			annotations: map[string]string{AnnotationSchemaVersion: "v9"},
+			wantErrs:    []string{`annotation secrets-consumer/schema-version: unsupported schema version "v9", supported versions are v1`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotErrs []string
+			if err := validateAnnotations(tt.annotations); err != nil {
+				if agg, ok := err.(interface{ Errors() []error }); ok {
+					for _, e := range agg.Errors() {
+						gotErrs = append(gotErrs, e.Error())
+					}
+				} else {
+					gotErrs = append(gotErrs, err.Error())
+				}
+			}
+			if diff := cmp.Diff(tt.wantErrs, gotErrs); diff != "" {
+				t.Errorf("validateAnnotations() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_secretManagerConfig_validatePod(t *testing.T) {
+	var smCfg secretManagerConfig
+	smCfg.vault.config.enabled = true
+	smCfg.vault.config.tlsSecretName = "vault-tls"
+
+	err := smCfg.validatePod(&corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "worker"}}})
+	agg, ok := err.(interface{ Errors() []error })
+	if !ok {
+		t.Fatalf("expected an aggregated error, got %v", err)
+	}
+	// every missing setting is reported, once for all the containers sharing the pod settings
+	if len(agg.Errors()) != 4 {
+		t.Errorf("expected 4 errors, got %v", agg.Errors())
+	}
+}
+
+func Test_parseVaultSecretConfigs(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+		wantErrs    []string
+	}{
+		{
+			name: "numbered configs are sorted numerically and keep their field types",
+			annotations: map[string]string{
+				"vault.secret.manager/secret-config-10": `{"path": "secret/ten", "use-secret-names-as-keys": "true"}`,
+				"vault.secret.manager/secret-config-2":  `{"Path": "secret/two", "Version": 2}`,
+				"vault.secret.manager/secret-config-1":  `{"path": "secret/one", "version": "3", "use-secret-names-as-keys": false}`,
+				"vault.secret.manager/secret-config-3":  `{"path": "secret/three", "version": 0}`,
+			},
+			want: []string{
+				`{"path":"secret/one","version":"3","use-secret-names-as-keys":false}`,
+				`{"path":"secret/two","version":2}`,
+				`{"path":"secret/three","version":0}`,
+				`{"path":"secret/ten","use-secret-names-as-keys":"true"}`,
+			},
+		},
+		{
+			name: "named configs are ordered by their order field",
+			annotations: map[string]string{
+				"vault.secret.manager/secret-config-db":    `{"path": "secret/db", "order": 5}`,
+				"vault.secret.manager/secret-config-cache": `{"path": "secret/cache", "order": 1}`,
+				"vault.secret.manager/secret-config-2":     `{"path": "secret/two"}`,
+				"vault.secret.manager/secret-config-first": `{"path": "secret/first", "order": 0}`,
+			},
+			want: []string{`{"path":"secret/first"}`, `{"path":"secret/cache"}`, `{"path":"secret/two"}`, `{"path":"secret/db"}`},
+		},
+		{
+			name: "invalid configs are reported precisely",
+			annotations: map[string]string{
+				"vault.secret.manager/secret-config-1":     `{"path": "secret/one"`,
+				"vault.secret.manager/secret-config-2":     `{"path": "secret/two", "paht": "typo"}`,
+				"vault.secret.manager/secret-config-3":     `{"Path": "a", "path": "b"}`,
+				"vault.secret.manager/secret-config-4":     `{"version": "latest"}`,
+				"vault.secret.manager/secret-config-db":    `{"path": "secret/db"}`,
+				"vault.secret.manager/secret-config-Cache": `{"path": "secret/cache", "order": 1}`,
+				"vault.secret.manager/secret-config-5":     `{"path": "secret/five", "order": 1}`,
+				"vault.secret.manager/secret-config-6":     `{"path": "secret/six"}`,
+				"vault.secret.manager/secret-config-7":     `{"path": "secret/seven", "version": -1}`,
+			},
+			want: []string{`{"path":"secret/six"}`},
+			wantErrs: []string{
+				`annotation vault.secret.manager/secret-config-1: expected a JSON object like {"path": "secret/data/app"}: unexpected end of JSON input`,
+				`annotation vault.secret.manager/secret-config-2: unknown field "paht", valid fields are path, version, use-secret-names-as-keys, order`,
+				`annotation vault.secret.manager/secret-config-3: field "path" is set more than once`,
+				`annotation vault.secret.manager/secret-config-4: [field "path" must be a non empty string, field "version" must be a non-negative number, got "latest"]`,
+				`annotation vault.secret.manager/secret-config-5: field "order" is only allowed on named configs, numbered configs are ordered by their number`,
+				`annotation vault.secret.manager/secret-config-7: field "version" must be a non-negative number, got "-1"`,
+				`annotation vault.secret.manager/secret-config-Cache: the suffix "Cache" must be a number or a name: a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')`,
+				`annotation vault.secret.manager/secret-config-db: field "order" is required on named configs`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVaultSecretConfigs(tt.annotations)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseVaultSecretConfigs() mismatch (-want +got):\n%s", diff)
+			}
+
+			var gotErrs []string
+			if agg, ok := err.(interface{ Errors() []error }); ok {
+				for _, e := range agg.Errors() {
+					gotErrs = append(gotErrs, e.Error())
+				}
+			}
+			if diff := cmp.Diff(tt.wantErrs, gotErrs); diff != "" {
+				t.Errorf("parseVaultSecretConfigs() errors mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// the audit log and the preflight check read the canonical configs whatever the field types
+	var config vaultSecretConfig
+	if err := json.Unmarshal([]byte(`{"path":"secret/two","version":2,"use-secret-names-as-keys":"true"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if want := (vaultSecretConfig{Path: "secret/two", Version: "2", UseSecretNamesAsKeys: true}); config != want {
+		t.Errorf("unexpected config %+v, want %+v", config, want)
+	}
+}
+
+func Test_mutatingWebhook_WorkloadValidator(t *testing.T) {
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(), logger: logrus.New()}
+	newDaemonSet := func(annotations map[string]string) *appsv1.DaemonSet {
+		return &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}}},
+		}}}
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantMessage string
+	}{
+		{
+			name: "valid template",
+			annotations: map[string]string{
+				AnnotationVaultEnabled:    "true",
+				AnnotationVaultService:    "https://vault:8200",
+				AnnotationVaultRole:       "app",
+				AnnotationVaultSecretPath: "secret/app",
+			},
+		},
+		{
+			name:        "template without secrets",
+			annotations: map[string]string{"app.kubernetes.io/name": "app"},
+		},
+		{
+			name: "invalid template",
+			annotations: map[string]string{
+				"vvault.secret.manager/enabled": "true",
+				AnnotationVaultEnabled:          "true",
+				AnnotationVaultService:          "https://vault:8200",
+			},
+			wantMessage: "invalid pod template: [unknown annotation vvault.secret.manager/enabled, did you mean vault.secret.manager/enabled?, " +
+				"Error getting vault secret path - make sure you either set the annotation vault.secret.manager/path or use the annotation vault.secret.manager/secret-config-x where x is the secret number, " +
+				"Error getting vault role - make sure you set the annotation vault.secret.manager/role]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, result, err := mw.WorkloadValidator(context.Background(), newDaemonSet(tt.annotations))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != (tt.wantMessage == "") || result.Message != tt.wantMessage {
+				t.Errorf("unexpected result %+v, want message %q", result, tt.wantMessage)
+			}
+		})
+	}
+}
+
+// fakeVault serves the Kubernetes auth login and the capabilities of the tokens it issues
+type fakeVault struct {
+	mu       sync.Mutex
+	requests int
+	delay    time.Duration
+	// roles maps the roles to the service account token they accept and the paths they can read
+	roles map[string]struct {
+		jwt   string
+		paths map[string][]string
+	}
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	v.requests++
+	delay := v.delay
+	v.mu.Unlock()
+	time.Sleep(delay)
+
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.URL.Path {
+	case "/v1/auth/kubernetes/login":
+		role, ok := v.roles[fmt.Sprint(body["role"])]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": ["invalid role name"]}`)
+			return
+		}
+		if role.jwt != body["jwt"] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"auth": {"client_token": "token-%s"}}`, body["role"])
+	case "/v1/sys/capabilities-self":
+		role := v.roles[strings.TrimPrefix(r.Header.Get("X-Vault-Token"), "token-")]
+		capabilities := map[string][]string{}
+		for _, path := range body["paths"].([]interface{}) {
+			capabilities[path.(string)] = []string{"deny"}
+			if caps, ok := role.paths[path.(string)]; ok {
+				capabilities[path.(string)] = caps
+			}
+		}
+		_ = json.NewEncoder(w).Encode(capabilities)
+	case "/v1/auth/token/revoke-self":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_mutatingWebhook_preflightCheck(t *testing.T) {
+	vault := &fakeVault{roles: map[string]struct {
+		jwt   string
+		paths map[string][]string
+	}{
+		"app": {jwt: "jwt-app", paths: map[string][]string{"secret/data/app": {"read"}, "secret/shared/": {"list", "read"}}},
+	}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	viper.Set("preflight_vault_addresses", server.URL)
+	defer viper.Set("preflight_vault_addresses", "")
+
+	newMutatingWebhook := func() *mutatingWebhook {
+		client := fake.NewSimpleClientset()
+		client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			create := action.(k8stesting.CreateAction)
+			if create.GetSubresource() != "token" {
+				return false, nil, nil
+			}
+			tr := create.GetObject().(*authenticationv1.TokenRequest).DeepCopy()
+			if !cmp.Equal(tr.Spec.Audiences, []string{"vault"}) {
+				return true, nil, fmt.Errorf("unexpected audiences %v", tr.Spec.Audiences)
+			}
+			tr.Status.Token = "jwt-" + action.(k8stesting.CreateActionImpl).Name
+			return true, tr, nil
+		})
+		mw := &mutatingWebhook{k8sClient: client, logger: logrus.New()}
+		mw.preflight = newPreflightChecker(client, mw.logger)
+		return mw
+	}
+	newPod := func(serviceAccount, role string, paths ...string) (*corev1.Pod, secretManagerConfig) {
+		var smCfg secretManagerConfig
+		smCfg.vault.config.enabled = true
+		smCfg.vault.config.addr = server.URL
+		smCfg.vault.config.role = role
+		smCfg.vault.config.path = paths[0]
+		for _, p := range paths[1:] {
+			smCfg.vault.config.secretConfigs = append(smCfg.vault.config.secretConfigs, fmt.Sprintf(`{"path":%q}`, p))
+		}
+		return &corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: serviceAccount, Containers: []corev1.Container{{Name: "app"}}}}, smCfg
+	}
+
+	tests := []struct {
+		name           string
+		serviceAccount string
+		role           string
+		paths          []string
+		wantErr        string
+	}{
+		{name: "allowed", serviceAccount: "app", role: "app", paths: []string{"secret/app", "secret/shared/", "secret/db*"}},
+		{name: "wrong service account", serviceAccount: "other", role: "app", paths: []string{"secret/app"},
+			wantErr: "preflight check of container app failed: service account other cannot log into vault with role app: permission denied"},
+		{name: "path denied", serviceAccount: "app", role: "app", paths: []string{"secret/app", "secret/db"},
+			wantErr: "preflight check of container app failed: vault role app cannot read secret/db"},
+		{name: "unknown role", serviceAccount: "app", role: "other", paths: []string{"secret/app"},
+			wantErr: "preflight check of container app failed: service account app cannot log into vault with role other: invalid role name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := newMutatingWebhook()
+			pod, smCfg := newPod(tt.serviceAccount, tt.role, tt.paths...)
+
+			err := mw.preflightCheck(context.Background(), pod, smCfg, "default")
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("preflightCheck() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("results are cached", func(t *testing.T) {
+		mw := newMutatingWebhook()
+		pod, smCfg := newPod("app", "app", "secret/app")
+
+		for i := 0; i < 3; i++ {
+			if err := mw.preflightCheck(context.Background(), pod, smCfg, "default"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if actions := mw.k8sClient.(*fake.Clientset).Actions(); len(actions) != 1 {
+			t.Errorf("expected a single token request, got %d", len(actions))
+		}
+	})
+
+	t.Run("vault addresses not allowed are not checked", func(t *testing.T) {
+		mw := newMutatingWebhook()
+		pod, smCfg := newPod("app", "app", "secret/app")
+		smCfg.vault.config.addr = "https://vault.attacker.example"
+
+		err := mw.preflightCheck(context.Background(), pod, smCfg, "default")
+		if err == nil || err.Error() != "preflight check of container app could not complete: vault address https://vault.attacker.example is not in preflight_vault_addresses" {
+			t.Errorf("unexpected error %v", err)
+		}
+		if actions := mw.k8sClient.(*fake.Clientset).Actions(); len(actions) != 0 {
+			t.Errorf("expected no token request, got %d", len(actions))
+		}
+	})
+
+	t.Run("dry runs are not checked", func(t *testing.T) {
+		mw := newMutatingWebhook()
+		mw.registry = &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}}
+		dryRun := true
+		ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Namespace: "default", DryRun: &dryRun})
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{
+				AnnotationVaultEnabled:    "true",
+				AnnotationVaultService:    server.URL,
+				AnnotationVaultSecretPath: "secret/db",
+				AnnotationVaultRole:       "app",
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}}},
+		}
+
+		if _, err := mw.SecretsMutator(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+		if actions := mw.k8sClient.(*fake.Clientset).Actions(); len(actions) != 0 {
+			t.Errorf("expected no token request, got %d", len(actions))
+		}
+	})
+
+	t.Run("vault certificates are verified without a CA", func(t *testing.T) {
+		tlsServer := httptest.NewTLSServer(vault)
+		defer tlsServer.Close()
+		viper.Set("preflight_vault_addresses", tlsServer.URL)
+		defer viper.Set("preflight_vault_addresses", server.URL)
+
+		pod, smCfg := newPod("app", "app", "secret/app")
+		smCfg.vault.config.addr = tlsServer.URL
+		err := newMutatingWebhook().preflightCheck(context.Background(), pod, smCfg, "default")
+		if err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("expected a certificate error, got %v", err)
+		}
+	})
+
+	t.Run("unreachable vault follows the failure policy", func(t *testing.T) {
+		viper.Set("preflight_timeout", "50ms")
+		vault.mu.Lock()
+		vault.delay = 200 * time.Millisecond
+		vault.mu.Unlock()
+		defer func() {
+			viper.Set("preflight_timeout", "3s")
+			viper.Set("preflight_failure_policy", preflightFailurePolicyReject)
+			vault.mu.Lock()
+			vault.delay = 0
+			vault.mu.Unlock()
+		}()
+
+		pod, smCfg := newPod("app", "app", "secret/app")
+		viper.Set("preflight_failure_policy", preflightFailurePolicyReject)
+		if err := newMutatingWebhook().preflightCheck(context.Background(), pod, smCfg, "default"); err == nil {
+			t.Error("expected the pod to be rejected")
+		}
+
+		viper.Set("preflight_failure_policy", preflightFailurePolicyAdmit)
+		if err := newMutatingWebhook().preflightCheck(context.Background(), pod, smCfg, "default"); err != nil {
+			t.Errorf("expected the pod to be admitted, got %s", err)
+		}
+	})
+}
+
+func Test_validatePreflightSettings(t *testing.T) {
+	for _, policy := range []string{preflightFailurePolicyReject, preflightFailurePolicyAdmit} {
+		if err := validatePreflightSettings("https://vault:8200", policy); err != nil {
+			t.Errorf("validatePreflightSettings(%q) error = %v", policy, err)
+		}
+	}
+
+	want := `[preflight_vault_addresses is empty, list the Vault addresses the ServiceAccount tokens may be sent to, invalid preflight_failure_policy "rejct", use "reject" or "admit"]`
+	if err := validatePreflightSettings(" , ", "rejct"); err == nil || err.Error() != want {
+		t.Errorf("validatePreflightSettings() error = %v, want %q", err, want)
+	}
+}
+
+func Test_certManager(t *testing.T) {
+	webhookConfig := &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets-consumer-webhook"},
+		Webhooks:   []admissionregistrationv1beta1.MutatingWebhook{{Name: "pods"}, {Name: "secrets"}},
+	}
+	client := fake.NewSimpleClientset(webhookConfig)
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &certManager{
+		client:         client,
+		namespace:      "vault",
+		secretName:     "webhook-tls",
+		dnsNames:       []string{"webhook", "webhook.vault", "webhook.vault.svc", "webhook.vault.svc.cluster.local"},
+		mutatingConfig: "secrets-consumer-webhook",
+		caValidity:     365 * 24 * time.Hour,
+		certValidity:   30 * 24 * time.Hour,
+		rotateBefore:   7 * 24 * time.Hour,
+		logger:         logrus.New(),
+		now:            func() time.Time { return now },
+	}
+
+	servingCert := func() *x509.Certificate {
+		cert, err := m.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	caBundle := func() *x509.CertPool {
+		config, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get("secrets-consumer-webhook", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, webhook := range config.Webhooks[1:] {
+			if !cmp.Equal(webhook.ClientConfig.CABundle, config.Webhooks[0].ClientConfig.CABundle) {
+				t.Fatalf("webhook %s has a different caBundle", webhook.Name)
+			}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(config.Webhooks[0].ClientConfig.CABundle) {
+			t.Fatal("invalid caBundle")
+		}
+		return pool
+	}
+	verify := func(cert *x509.Certificate) {
+		_, err := cert.Verify(x509.VerifyOptions{DNSName: "webhook.vault.svc", Roots: caBundle(), CurrentTime: now})
+		if err != nil {
+			t.Errorf("serving certificate does not verify against the caBundle: %s", err)
+		}
+	}
+
+	if err := m.ensure(); err != nil {
+		t.Fatal(err)
+	}
+	first := servingCert()
+	verify(first)
+
+	t.Run("keeps valid certificates", func(t *testing.T) {
+		if err := m.ensure(); err != nil {
+			t.Fatal(err)
+		}
+		if !servingCert().Equal(first) {
+			t.Error("expected the serving certificate to be kept")
+		}
+	})
+
+	t.Run("rotates the serving certificate before it expires", func(t *testing.T) {
+		now = now.Add(24 * 24 * time.Hour)
+		if err := m.ensure(); err != nil {
+			t.Fatal(err)
+		}
+		rotated := servingCert()
+		if rotated.Equal(first) {
+			t.Fatal("expected a new serving certificate")
+		}
+		if rotated.Issuer.CommonName != first.Issuer.CommonName {
+			t.Error("expected the CA to be kept")
+		}
+		verify(rotated)
+	})
+
+	t.Run("rotates the CA and keeps trusting the previous one", func(t *testing.T) {
+		previous := servingCert()
+		now = now.Add(340 * 24 * time.Hour)
+		if err := m.ensure(); err != nil {
+			t.Fatal(err)
+		}
+		rotated := servingCert()
+		if rotated.Issuer.CommonName == previous.Issuer.CommonName {
+			t.Fatal("expected a new CA")
+		}
+		verify(rotated)
+		// other replicas may still serve a certificate signed by the previous CA
+		now = previous.NotAfter.Add(-time.Hour)
+		verify(previous)
+	})
+
+	t.Run("loads certificates rotated by another replica", func(t *testing.T) {
+		other := &certManager{
+			client:         client,
+			namespace:      m.namespace,
+			secretName:     m.secretName,
+			dnsNames:       m.dnsNames,
+			mutatingConfig: m.mutatingConfig,
+			caValidity:     m.caValidity,
+			certValidity:   m.certValidity,
+			rotateBefore:   m.rotateBefore,
+			logger:         m.logger,
+			now:            m.now,
+		}
+		if err := other.ensure(); err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := other.GetCertificate(nil)
+		if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); !servingCert().Equal(leaf) {
+			t.Error("expected both replicas to serve the same certificate")
+		}
+	})
+
+	t.Run("switches the serving certificate once the caBundle is patched", func(t *testing.T) {
+		failUpdates := true
+		client.PrependReactor("update", "mutatingwebhookconfigurations", func(k8stesting.Action) (bool, runtime.Object, error) {
+			if failUpdates {
+				return true, nil, fmt.Errorf("the server is unavailable")
+			}
+			return false, nil, nil
+		})
+
+		previous := servingCert()
+		now = now.Add(360 * 24 * time.Hour)
+		if err := m.ensure(); err == nil {
+			t.Fatal("expected the caBundle patch to fail")
+		}
+		if !servingCert().Equal(previous) {
+			t.Error("expected the previous certificate to be served until the caBundle is patched")
+		}
+
+		failUpdates = false
+		if err := m.ensure(); err != nil {
+			t.Fatal(err)
+		}
+		rotated := servingCert()
+		if rotated.Equal(previous) {
+			t.Fatal("expected a new serving certificate")
+		}
+		verify(rotated)
+	})
+}
+
+func Test_shutdownOnSignal(t *testing.T) {
+	viper.Set("shutdown_delay", "100ms")
+	viper.Set("shutdown_timeout", "5s")
+	defer func() {
+		viper.Set("shutdown_delay", "5s")
+		viper.Set("shutdown_timeout", "20s")
+	}()
+
+	ready := newReadiness()
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", http.HandlerFunc(ready.readyzHandler))
+	mux.Handle("/pods", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config = newHTTPServer("", mux)
+	ts.Start()
+	defer ts.Close()
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- shutdownOnSignal(signals, make(chan error), ready, nil, logrus.New(), ts.Config)
+	}()
+
+	inFlight := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL+"/pods", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+
+	<-started
+	signals <- syscall.SIGTERM
+
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the readiness probe to fail while draining, got %d", resp.StatusCode)
+	}
+
+	if status := <-inFlight; status != http.StatusOK {
+		t.Errorf("expected the in-flight admission to complete, got %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_withBodyLimit(t *testing.T) {
+	viper.Set("server_max_body_bytes", 16)
+	defer viper.Set("server_max_body_bytes", 6<<20)
+
+	handler := withBodyLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+
+	for body, expected := range map[string]int{
+		"{}":                          http.StatusOK,
+		strings.Repeat("x", 17):       http.StatusRequestEntityTooLarge,
+		strings.Repeat("chunked", 10): http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pods", strings.NewReader(body))
+		if strings.HasPrefix(body, "chunked") {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("body of %d bytes: expected %d, got %d", len(body), expected, w.Code)
+		}
+	}
+}
+
+func Test_withClientCert(t *testing.T) {
+	viper.Set("tls_client_ca_file", "/etc/webhook/client-ca.crt")
+	viper.Set("tls_client_allowed_names", "kube-apiserver")
+	defer func() {
+		viper.Set("tls_client_ca_file", "")
+		viper.Set("tls_client_allowed_names", "")
+	}()
+
+	handler := withClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	withCert := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	tests := []struct {
+		name     string
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{name: "plain HTTP", expected: http.StatusUnauthorized},
+		{name: "no client certificate", tls: &tls.ConnectionState{}, expected: http.StatusUnauthorized},
+		{name: "allowed common name", tls: withCert(&x509.Certificate{Subject: pkix.Name{CommonName: "kube-apiserver"}}), expected: http.StatusOK},
+		{name: "allowed DNS name", tls: withCert(&x509.Certificate{DNSNames: []string{"kube-apiserver"}}), expected: http.StatusOK},
+		{name: "other name", tls: withCert(&x509.Certificate{Subject: pkix.Name{CommonName: "someone"}}), expected: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/pods", nil)
+			req.TLS = tt.tls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func Test_readiness(t *testing.T) {
+	viper.Set("readyz_check_timeout", "100ms")
+	defer viper.Set("readyz_check_timeout", "5s")
+
+	m := &certManager{dnsNames: []string{"webhook", "webhook.vault", "webhook.vault.svc", "webhook.vault.svc.cluster.local"}, caValidity: 24 * time.Hour, certValidity: 2 * time.Hour}
+	ca, caKey, err := m.newCA(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := m.newServingCert(time.Now(), ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{viper.GetString("secrets_consumer_env_image"): {}}}
+	ready := newReadiness(
+		apiCheck(fake.NewSimpleClientset()),
+		envImageCheck(fake.NewSimpleClientset(), reg, logrus.New()),
+		certificateCheck(func() (*tls.Certificate, error) { return &cert, nil }),
+		readinessCheck{name: "stuck", check: func(context.Context) error { time.Sleep(time.Second); return nil }},
+	)
+
+	readyz := func() (int, string) {
+		w := httptest.NewRecorder()
+		ready.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz?verbose", nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]api failed: not checked yet") {
+		t.Errorf("expected not ready before the first checks, got %d:\n%s", code, body)
+	}
+
+	ready.runChecks(context.Background())
+	code, body := readyz()
+	expected := `[+]api ok
+[-]certificate failed: the serving certificate expires in 2h
+[+]env-image ok
+[-]stuck failed: timed out: context deadline exceeded
+[+]shutdown ok
+readyz check failed
+`
+	// the remaining validity depends on how long the test ran
+	body = regexp.MustCompile(`expires in \S+`).ReplaceAllString(body, "expires in 2h")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if diff := cmp.Diff(expected, body); diff != "" {
+		t.Errorf("readyz body mismatch (-want +got):\n%s", diff)
+	}
+
+	for check, expected := range map[string]float64{"api": 1, "env-image": 1, "certificate": 0, "stuck": 0} {
+		if got := testutil.ToFloat64(readinessChecks.WithLabelValues(check)); got != expected {
+			t.Errorf("check %s: expected the metric to be %v, got %v", check, expected, got)
+		}
+	}
+
+	// the env image is only reported with ?verbose, and does not fail the probe
+	ready = newReadiness(apiCheck(fake.NewSimpleClientset()), envImageCheck(fake.NewSimpleClientset(), &fakeImageRegistry{}, logrus.New()))
+	ready.runChecks(context.Background())
+	if code, body := readyz(); code != http.StatusOK || !strings.Contains(body, "[-]env-image failed: cannot resolve") {
+		t.Errorf("expected ready with a failed env-image check, got %d:\n%s", code, body)
+	}
+	w := httptest.NewRecorder()
+	ready.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if expected := "[+]api ok\n[+]shutdown ok\nreadyz check passed\n"; w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("expected %q, got %d:\n%s", expected, w.Code, w.Body.String())
+	}
+	ready.drain()
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]shutdown failed") {
+		t.Errorf("expected not ready while shutting down, got %d:\n%s", code, body)
+	}
+
+	// the env image lookup bypasses the image cache, and fails the probe with readyz_env_image_gating
+	viper.Set("readyz_env_image_gating", true)
+	defer viper.Set("readyz_env_image_gating", false)
+	failing := &fakeImageRegistry{}
+	ready = newReadiness(apiCheck(fake.NewSimpleClientset()), envImageCheck(fake.NewSimpleClientset(), failing, logrus.New()))
+	ready.runChecks(context.Background())
+	w = httptest.NewRecorder()
+	ready.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "[-]env-image failed: cannot resolve") {
+		t.Errorf("expected not ready with a failed gating env-image check, got %d:\n%s", w.Code, w.Body.String())
+	}
+	if diff := cmp.Diff([]corev1.PullPolicy{corev1.PullAlways}, failing.policies); diff != "" {
+		t.Errorf("env image lookup pull policies mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_mutatingWebhook_SecretsMutator_metrics(t *testing.T) {
+	reg := &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "metrics"},
+		Data:       map[string]string{"API_KEY": "vault:API_KEY"},
+	}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(configMap), registry: reg, logger: logrus.New()}
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Namespace: "metrics"})
+
+	vaultAnnotations := func(extra map[string]string) map[string]string {
+		annotations := map[string]string{
+			AnnotationVaultEnabled:    "true",
+			AnnotationVaultService:    "https://vault:8200",
+			AnnotationVaultSecretPath: "secret/app",
+			AnnotationVaultRole:       "app",
+		}
+		for k, v := range extra {
+			annotations[k] = v
+		}
+		return annotations
+	}
+	newPod := func(annotations map[string]string, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  "app",
+				Image: image,
+				EnvFrom: []corev1.EnvFromSource{{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}},
+				}},
+			}}},
+		}
+	}
+
+	mutated := newPod(vaultAnnotations(nil), "app:1.0")
+	for _, pod := range []*corev1.Pod{
+		newPod(nil, "app:1.0"),
+		mutated,
+		mutated,
+		newPod(vaultAnnotations(map[string]string{AnnotationAWSSecretManagerEnabled: "true", AnnotationAWSSecretManagerSecretName: "app"}), "unknown:1.0"),
+		newPod(vaultAnnotations(map[string]string{AnnotationVaultEnabled: "yes"}), "app:1.0"),
+		newPod(vaultAnnotations(map[string]string{AnnotationExcludeContainers: "app"}), "app:1.0"),
+	} {
+		_, _ = mw.SecretsMutator(ctx, pod)
+	}
+
+	for labels, expected := range map[[3]string]float64{
+		{"none", "skipped", reasonNotEnabled}:      1,
+		{"vault", "mutated", ""}:                   1,
+		{"vault", "skipped", reasonAlreadyMutated}: 1,
+		{"aws", "rejected", reasonImageConfig}:     1,
+		{"vault", "rejected", reasonImageConfig}:   1,
+		{"none", "rejected", reasonInvalidConfig}:  1,
+		{"vault", "skipped", reasonNoContainers}:   1,
+	} {
+		if got := testutil.ToFloat64(mutations.WithLabelValues("metrics", labels[0], labels[1], labels[2])); got != expected {
+			t.Errorf("mutations %v: expected %v, got %v", labels, expected, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(referenceResolutions.WithLabelValues("configmap", "api", "found")); got == 0 {
+		t.Error("expected the ConfigMap reads to be counted")
+	}
+}
+
+// recordSpans installs a tracer provider exporting to an in-process exporter, until reset is called
+func recordSpans() (exporter *tracetest.InMemoryExporter, reset func()) {
+	exporter = tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter, func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) }
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func Test_tracedWebhook(t *testing.T) {
+	exporter, reset := recordSpans()
+	defer reset()
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "tracing"},
+		Data:       map[string]string{"API_KEY": "vault:API_KEY"},
+	}
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(configMap),
+		registry:  &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}},
+		logger:    logrus.New(),
+	}
+	handler := handlerFor(mutating.WebhookConfig{Name: "pods", Obj: &corev1.Pod{}}, mutating.MutatorFunc(mw.SecretsMutator), nil, logrus.New())
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tracing", Annotations: map[string]string{
+			AnnotationVaultEnabled:    "true",
+			AnnotationVaultService:    "https://vault:8200",
+			AnnotationVaultSecretPath: "secret/app",
+			AnnotationVaultRole:       "app",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "app:1.0",
+			Env: []corev1.EnvVar{{Name: "API_KEY", ValueFrom: &corev1.EnvVarSource{
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}, Key: "API_KEY"},
+			}}},
+		}}},
+	}
+	raw, _ := json.Marshal(pod)
+	review, _ := json.Marshal(admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       "trace-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "tracing",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pods", strings.NewReader(string(review))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	root, ok := spans["admission"]
+	if !ok {
+		t.Fatalf("expected an admission span, got %v", spans)
+	}
+	for _, name := range []string{"admission.decode", "admission.parse_config", "references.value_from", "references.api_get", "admission.patch"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("expected %s in the admission trace", name)
+		}
+	}
+	for name, span := range spans {
+		if got := spanAttribute(span, attributeAdmissionUID); got != "trace-uid" {
+			t.Errorf("expected the admission UID on %s, got %q", name, got)
+		}
+	}
+
+	if parent := spans["references.api_get"].Parent.SpanID(); parent != spans["references.value_from"].SpanContext.SpanID() {
+		t.Error("expected the API read to be a child of the env var resolution")
+	}
+	if got := spanAttribute(spans["references.api_get"], "k8s.name"); got != "app-config" {
+		t.Errorf("expected the ConfigMap name on the API read, got %q", got)
+	}
+	if !spans["admission.decode"].EndTime.Before(spans["admission.parse_config"].StartTime) {
+		t.Error("expected the decode span to end before the mutation")
+	}
+	if spans["admission.patch"].StartTime.Before(spans["references.api_get"].EndTime) {
+		t.Error("expected the patch span to start after the mutation")
+	}
+}
+
+func Test_otlpExporter(t *testing.T) {
+	var path, auth, contentType string
+	var requests int
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, contentType = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+		requests++
+	}))
+	defer collector.Close()
+
+	viper.Set("tracing_otlp_headers", "Authorization=Bearer token")
+	defer viper.Set("tracing_otlp_headers", "")
+
+	if _, err := newOTLPExporter("collector:4318"); err == nil {
+		t.Error("expected an endpoint without scheme to be rejected")
+	}
+	exporter, err := newOTLPExporter(collector.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer("test").Start(context.Background(), "registry.manifest", trace.WithAttributes(attribute.Int("retries", 2)))
+	endSpan(span, fmt.Errorf("manifest unknown"))
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 1 || path != "/v1/traces" || auth != "Bearer token" || contentType != "application/x-protobuf" {
+		t.Errorf("expected a protobuf request to /v1/traces with the headers, got %d requests %q %q %q", requests, path, auth, contentType)
+	}
+}
+
+func Test_mutatingWebhook_eventTarget(t *testing.T) {
+	controller := true
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f", Namespace: "events",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "deployment-uid", Controller: &controller}},
+	}}
+	mw := &mutatingWebhook{k8sClient: fake.NewSimpleClientset(replicaSet), logger: logrus.New()}
+
+	ownedBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, UID: types.UID(name + "-uid"), Controller: &controller}}
+	}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want *corev1.ObjectReference
+	}{
+		{
+			name: "Deployment of the ReplicaSet",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-5d8f-", OwnerReferences: ownedBy("ReplicaSet", "web-5d8f")}},
+			want: &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "events", Name: "web", UID: "deployment-uid"},
+		},
+		{
+			name: "ReplicaSet that cannot be read",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "other-", OwnerReferences: ownedBy("ReplicaSet", "other")}},
+			want: &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Namespace: "events", Name: "other", UID: "other-uid"},
+		},
+		{
+			name: "Job",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "migrate-", OwnerReferences: ownedBy("Job", "migrate")}},
+			want: &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Job", Namespace: "events", Name: "migrate", UID: "migrate-uid"},
+		},
+		{
+			name: "pod without controller",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug"}},
+			want: &corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "events", Name: "debug"},
+		},
+		{
+			name: "pod without controller nor name",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "debug-"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, mw.eventTarget(tt.pod, "events")); diff != "" {
+				t.Errorf("eventTarget() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_mutatingWebhook_SecretsMutator_events(t *testing.T) {
+	controller := true
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f", Namespace: "events",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: &controller}},
+	}}
+	recorder := record.NewFakeRecorder(10)
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(replicaSet),
+		registry:  &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}},
+		logger:    logrus.New(),
+		recorder:  recorder,
+	}
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Namespace: "events"})
+	dryRun := true
+	dryRunCtx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Namespace: "events", DryRun: &dryRun})
+
+	newPod := func(annotations map[string]string, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName:    "web-5d8f-",
+				Annotations:     annotations,
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", Controller: &controller}},
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+	}
+	vault := map[string]string{
+		AnnotationVaultEnabled:    "true",
+		AnnotationVaultService:    "https://vault:8200",
+		AnnotationVaultSecretPath: "secret/app",
+		AnnotationVaultRole:       "app",
+	}
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		annotations map[string]string
+		image       string
+		want        string
+	}{
+		{
+			name:  "pod without the webhook annotations",
+			ctx:   ctx,
+			image: "app:1.0",
+		},
+		{
+			name:        "dry run",
+			ctx:         dryRunCtx,
+			annotations: vault,
+			image:       "app:1.0",
+		},
+		{
+			name:        "mutated",
+			ctx:         ctx,
+			annotations: vault,
+			image:       "app:1.0",
+			want:        "Normal SecretsInjected Injected vault secrets into containers app of pod web-5d8f-",
+		},
+		{
+			name:        "no backend enabled",
+			ctx:         ctx,
+			annotations: map[string]string{AnnotationVaultSecretPath: "secret/app"},
+			image:       "app:1.0",
+			want:        "Normal SecretsInjectionSkipped Skipped pod web-5d8f-: no secret manager is enabled, set aws.secret.manager/enabled, gcp.secret.manager/enabled or vault.secret.manager/enabled to true",
+		},
+		{
+			name:        "rejected",
+			ctx:         ctx,
+			annotations: vault,
+			image:       "unknown:1.0",
+			want:        "Warning SecretsInjectionFailed Rejected pod web-5d8f-: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _ = mw.SecretsMutator(tt.ctx, newPod(tt.annotations, tt.image))
+
+			if tt.want == "" {
+				select {
+				case event := <-recorder.Events:
+					t.Errorf("expected no event, got %q", event)
+				default:
+				}
+				return
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, tt.want) {
+					t.Errorf("expected an event starting with %q, got %q", tt.want, event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("expected an event %q", tt.want)
+			}
+		})
+	}
+
+	t.Run("admitted with unresolved commands", func(t *testing.T) {
+		viper.Set("image_config_failure_policy", imageConfigFailurePolicyAdmitWithWarning)
+		defer viper.Set("image_config_failure_policy", imageConfigFailurePolicyReject)
+
+		pod := newPod(vault, "app:1.0")
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "worker", Image: "unknown:1.0"}, corev1.Container{Name: "cron", Image: "unknown:2.0"})
+		if _, err := mw.SecretsMutator(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+
+		var warnings []string
+		for i := 0; i < 3; i++ {
+			select {
+			case event := <-recorder.Events:
+				if strings.HasPrefix(event, "Warning SecretsCommandUnresolved Admitted pod web-5d8f-, the wrapper resolves the command when the container starts: ") {
+					warnings = append(warnings, event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected 3 events, got %d", i)
+			}
+		}
+		if len(warnings) != 2 {
+			t.Errorf("expected a warning per container without a detected command, got %v", warnings)
+		}
+	})
+}
+
+func Test_mutatingWebhook_SecretsMutator_audit(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-secret", Namespace: "audit"},
+		Data:       map[string][]byte{"PASSWORD": []byte("s3cr3t-value"), "API_KEY": []byte("vault:API_KEY")},
+	}
+	var out strings.Builder
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(secret),
+		registry:  &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}},
+		logger:    logrus.New(),
+		audit:     &auditor{sinks: []auditSink{&writerSink{w: &out}}, logger: logrus.New()},
+	}
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{
+		UID:       "audit-uid",
+		Namespace: "audit",
+		Operation: admissionv1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller", Groups: []string{"system:serviceaccounts"}},
+	})
+
+	controller := true
+	newPod := func(annotations map[string]string, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName:    "web-5d8f-",
+				Annotations:     annotations,
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", Controller: &controller}},
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "web",
+				Containers: []corev1.Container{{
+					Name:    "app",
+					Image:   image,
+					EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-secret"}}}},
+				}},
+			},
+		}
+	}
+	annotations := map[string]string{
+		AnnotationVaultEnabled:                         "true",
+		AnnotationVaultService:                         "https://vault:8200",
+		AnnotationVaultRole:                            "web",
+		AnnotationVaultMultiSecretPrefix + "1":         `{"path": "secret/web", "version": "2"}`,
+		AnnotationVaultMultiSecretPrefix + "2":         `{"path": "secret/shared"}`,
+		"aws.secret.manager/container.app.enabled":     "true",
+		"aws.secret.manager/container.app.region":      "eu-west-1",
+		"aws.secret.manager/container.app.secret-name": "web/prod",
+		"aws.secret.manager/container.app.role-arn":    "arn:aws:iam::123456789012:role/web",
+	}
+
+	_, _ = mw.SecretsMutator(ctx, newPod(annotations, "app:1.0"))
+	_, _ = mw.SecretsMutator(ctx, newPod(annotations, "unknown:1.0"))
+	_, _ = mw.SecretsMutator(ctx, newPod(nil, "app:1.0"))
+
+	if strings.Contains(out.String(), "s3cr3t-value") {
+		t.Fatalf("the audit log contains a secret value: %s", out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a record for the mutated and the denied pods only, got %d: %s", len(lines), out.String())
+	}
+
+	var records []auditRecord
+	for _, line := range lines {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		record.Time = time.Time{}
+		records = append(records, record)
+	}
+
+	secrets := []auditSecretSource{
+		{Backend: "vault", Address: "https://vault:8200", Role: "web", Path: "secret/web", Version: "2"},
+		{Backend: "vault", Address: "https://vault:8200", Role: "web", Path: "secret/shared"},
+		// the container scoped annotations override the pod ones for that container only
+		{Backend: "aws", Container: "app", Region: "eu-west-1", SecretName: "web/prod", RoleARN: "arn:aws:iam::123456789012:role/web"},
+		{Backend: "vault", Container: "app", Address: "https://vault:8200", Role: "web", Path: "secret/web", Version: "2"},
+		{Backend: "vault", Container: "app", Address: "https://vault:8200", Role: "web", Path: "secret/shared"},
+	}
+	user := auditUser{Username: "system:serviceaccount:kube-system:replicaset-controller", Groups: []string{"system:serviceaccounts"}}
+	pod := auditPod{Namespace: "audit", GenerateName: "web-5d8f-", ServiceAccount: "web", Owner: &auditOwner{Kind: "ReplicaSet", Name: "web-5d8f"}}
+	mutatedPod := pod
+	mutatedPod.Containers = []string{"app"}
+
+	want := []auditRecord{
+		{SchemaVersion: "v1", AdmissionUID: "audit-uid", Operation: "CREATE", Decision: "mutated", User: user, Pod: mutatedPod, Secrets: secrets},
+		{SchemaVersion: "v1", AdmissionUID: "audit-uid", Operation: "CREATE", Decision: "denied", Reason: reasonImageConfig, User: user, Pod: pod, Secrets: secrets},
+	}
+	if diff := cmp.Diff(want, records, cmp.FilterPath(func(p cmp.Path) bool { return p.Last().String() == ".Error" }, cmp.Ignore())); diff != "" {
+		t.Errorf("audit records mismatch (-want +got):\n%s", diff)
+	}
+	if records[1].Error == "" {
+		t.Error("expected the error of the denied pod")
+	}
+}
+
+func Test_fileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/audit.log"
+	sink, err := newFileSink(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if err := sink.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, expected := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("expected %q in %s, got %q", expected, file, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+}
+
+func Test_httpSink(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.Header.Get("Authorization") + " " + string(body)
+	}))
+	defer server.Close()
+
+	viper.Set("audit_http_headers", "Authorization=Bearer token")
+	defer viper.Set("audit_http_headers", "")
+
+	if _, err := newHTTPSink("audit.example.com", logrus.New()); err == nil {
+		t.Error("expected a URL without scheme to be rejected")
+	}
+	sink, err := newHTTPSink(server.URL, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.write([]byte(`{"decision":"mutated"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if expected := "Bearer token {\"decision\":\"mutated\"}\n"; got != expected {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the record to be posted")
+	}
+
+	t.Run("close sends the waiting records", func(t *testing.T) {
+		var mu sync.Mutex
+		var posted []string
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			posted = append(posted, string(body))
+			mu.Unlock()
+		}))
+		defer slow.Close()
+
+		sink, err := newHTTPSink(slow.URL, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := sink.write([]byte(fmt.Sprintf("{\"record\":%d}\n", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := sink.close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if len(posted) != 3 {
+			t.Errorf("expected the 3 records to be posted before close returns, got %v", posted)
+		}
+		mu.Unlock()
+		if err := sink.write([]byte("{}\n")); err == nil {
+			t.Error("expected the records written after close to be dropped")
+		}
+	})
+
+	t.Run("close is bounded by the context", func(t *testing.T) {
+		release := make(chan struct{})
+		stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+		defer stuck.Close()
+		defer close(release)
+
+		sink, err := newHTTPSink(stuck.URL, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.write([]byte("{}\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := sink.close(ctx); err == nil {
+			t.Error("expected close to give up on the stuck endpoint")
+		}
+	})
+}
+
+func Test_mutatingWebhook_SecretsMutator_logger(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	mw := &mutatingWebhook{
+		k8sClient: fake.NewSimpleClientset(),
+		registry:  &fakeImageRegistry{configs: map[string]*imagev1.ImageConfig{"app:1.0": {Entrypoint: []string{"/app"}}}},
+		logger:    logger,
+	}
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{
+		UID:       "log-uid",
+		Namespace: "logs",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "web-5d8f-", Annotations: map[string]string{
+			AnnotationVaultEnabled:    "true",
+			AnnotationVaultService:    "https://vault:8200",
+			AnnotationVaultRole:       "web",
+			AnnotationVaultSecretPath: "secret/web",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "app:1.0",
+			Env:   []corev1.EnvVar{{Name: "PASSWORD", Value: "vault:secret/web#PASSWORD"}},
+		}}},
+	}
+
+	if _, err := mw.SecretsMutator(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+
+	registryLogged := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["admission_uid"] != "log-uid" || entry.Data["namespace"] != "logs" || entry.Data["generate_name"] != "web-5d8f-" {
+			t.Errorf("%q is logged without the admission fields: %v", entry.Message, entry.Data)
+		}
+		if strings.HasPrefix(entry.Message, "Getting the image config") {
+			registryLogged = true
+			if entry.Data["container"] != "app" {
+				t.Errorf("%q is logged without the container: %v", entry.Message, entry.Data)
+			}
+		}
+	}
+	if !registryLogged {
+		t.Error("the registry lookup was not logged")
+	}
+	// the webhook logger itself is left unscoped
+	if mw.logger != logrus.FieldLogger(logger) {
+		t.Error("the logger of the webhook was replaced")
+	}
+}
+
+func Test_handleTelemetry(t *testing.T) {
+	logger := logrus.New()
+	mux := http.NewServeMux()
+	handleTelemetry(mux, logger)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/loglevel?level=debug", nil))
+	if rec.Code != http.StatusOK || logger.GetLevel() != logrus.DebugLevel {
+		t.Errorf("expected the log level to change to debug, got %d %s: %s", rec.Code, logger.GetLevel(), rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the metrics to be served, got %d", rec.Code)
+	}
+}
+
+func Test_logLevelHandler(t *testing.T) {
+	logger := logrus.New()
+	handler := logLevelHandler(logger)
+
+	tests := []struct {
+		method string
+		target string
+		status int
+		level  logrus.Level
+	}{
+		{method: http.MethodGet, target: "/loglevel", status: http.StatusOK, level: logrus.InfoLevel},
+		{method: http.MethodPut, target: "/loglevel?level=debug", status: http.StatusOK, level: logrus.DebugLevel},
+		{method: http.MethodPut, target: "/loglevel?level=verbose", status: http.StatusBadRequest, level: logrus.DebugLevel},
+		{method: http.MethodDelete, target: "/loglevel", status: http.StatusMethodNotAllowed, level: logrus.DebugLevel},
+		{method: http.MethodPost, target: "/loglevel?level=warn", status: http.StatusOK, level: logrus.WarnLevel},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+
+		if rec.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", test.method, test.target, test.status, rec.Code, rec.Body)
+		}
+		if logger.GetLevel() != test.level {
+			t.Errorf("%s %s: expected level %s, got %s", test.method, test.target, test.level, logger.GetLevel())
+		}
+		if want := fmt.Sprintf(`{"level":%q}`, test.level) + "\n"; test.status == http.StatusOK && rec.Body.String() != want {
+			t.Errorf("%s %s: expected %s, got %s", test.method, test.target, want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var entrypointResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "entrypoint_resolutions_total",
+	Help:      "Resolutions of the command of containers without an explicit one, by outcome: hint, pod_template, registry, admitted_with_warning or rejected.",
+}, []string{"outcome"})
+
+var readinessChecks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "readiness_check",
+	Help:      "Whether a readiness check passed (1) or failed (0), by check: api, informers, certificate or env-image.",
+}, []string{"check"})
+
+var mutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "mutations_total",
+	Help:      "Pod admissions by namespace, backend (aws, gcp, vault or none), outcome (mutated, skipped or rejected) and reason of skipped and rejected pods.",
+}, []string{"namespace", "backend", "outcome", "reason"})
+
+var mutationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "mutation_duration_seconds",
+	Help:      "Duration of the pod mutations by outcome: mutated, skipped or rejected.",
+	Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+}, []string{"outcome"})
+
+var referenceResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "reference_resolutions_total",
+	Help:      "Reads of the ConfigMaps and Secrets referenced by pods, by kind (configmap or secret), source (admission_cache, informer or api) and outcome (found, not_found or error).",
+}, []string{"kind", "source", "outcome"})
+
+var auditRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Name:      "audit_records_total",
+	Help:      "Audit records by sink (stdout, file or http) and outcome: written, error, or dropped when too many records wait to be sent.",
+}, []string{"sink", "outcome"})
+
+func init() {
+	prometheus.MustRegister(entrypointResolutions)
+	prometheus.MustRegister(readinessChecks)
+	prometheus.MustRegister(mutations)
+	prometheus.MustRegister(mutationDuration)
+	prometheus.MustRegister(referenceResolutions)
+	prometheus.MustRegister(auditRecords)
+}
+
+// reasons of the skipped and rejected mutations
+const (
+	reasonNotEnabled      = "not_enabled"
+	reasonAlreadyMutated  = "already_mutated"
+	reasonNoContainers    = "no_containers"
+	reasonInvalidConfig   = "invalid_config"
+	reasonPreflightDenied = "preflight_denied"
+	reasonPreflightError  = "preflight_error"
+	reasonImageConfig     = "image_config"
+	reasonReference       = "reference"
+	reasonOther           = "other"
+)
+
+// mutationFailure is an error rejecting a pod, with the reason reported in the metrics
+type mutationFailure struct {
+	reason string
+	err    error
+}
+
+func (e *mutationFailure) Error() string {
+	return e.err.Error()
+}
+
+func failureReason(err error) string {
+	if f, ok := err.(*mutationFailure); ok {
+		return f.reason
+	}
+	return reasonOther
+}
+
+// recordMutation counts a pod admission once for every backend it uses
+func recordMutation(ns string, smCfg secretManagerConfig, outcome, reason string, start time.Time) {
+	backends := smCfg.enabledBackends()
+	if len(backends) == 0 {
+		backends = []string{"none"}
+	}
+	for _, backend := range backends {
+		mutations.WithLabelValues(ns, backend, outcome, reason).Inc()
+	}
+	mutationDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// recordReference counts a read of a referenced ConfigMap or Secret
+func recordReference(kind, source string, err error) {
+	outcome := "found"
+	switch {
+	case apierrors.IsNotFound(err):
+		outcome = "not_found"
+	case err != nil:
+		outcome = "error"
+	}
+	referenceResolutions.WithLabelValues(kind, source, outcome).Inc()
+}
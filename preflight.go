@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultVaultLoginPath is the login path of the Kubernetes auth method mounted at the default path
+	defaultVaultLoginPath = "auth/kubernetes/login"
+
+	// defaultPreflightTokenAudience is the audience of the ServiceAccount tokens sent to Vault when
+	// preflight_token_audiences is empty, so that they are never valid against the API server
+	defaultPreflightTokenAudience = "vault"
+
+	// preflightFailurePolicyReject denies the pods whose preflight check cannot complete
+	preflightFailurePolicyReject = "reject"
+
+	// preflightFailurePolicyAdmit admits the pods whose preflight check cannot complete, e.g. Vault is unreachable
+	preflightFailurePolicyAdmit = "admit"
+)
+
+// accessDeniedError is a preflight failure caused by the backend policies, as opposed to not
+// being able to reach the backend
+type accessDeniedError struct {
+	msg string
+}
+
+func (e *accessDeniedError) Error() string {
+	return e.msg
+}
+
+func isAccessDenied(err error) bool {
+	_, ok := err.(*accessDeniedError)
+	return ok
+}
+
+// vaultResponseError is an error response of the Vault HTTP API other than 403
+type vaultResponseError struct {
+	path       string
+	statusCode int
+	msg        string
+}
+
+func (e *vaultResponseError) Error() string {
+	return fmt.Sprintf("vault %s: %s", e.path, e.msg)
+}
+
+// preflightChecker checks at admission that the ServiceAccount of a pod can read the secrets
+// it asks for, by logging into Vault with a short-lived token of the ServiceAccount
+type preflightChecker struct {
+	client  kubernetes.Interface
+	results *cache.Cache
+	logger  log.FieldLogger
+}
+
+func newPreflightChecker(client kubernetes.Interface, logger log.FieldLogger) *preflightChecker {
+	return &preflightChecker{
+		client:  client,
+		results: cache.New(viper.GetDuration("preflight_cache_ttl"), time.Minute),
+		logger:  logger,
+	}
+}
+
+// vaultPreflight is what a container asks Vault for
+type vaultPreflight struct {
+	addr      string
+	loginPath string
+	role      string
+	paths     []string
+	caCert    []byte
+}
+
+func (v vaultPreflight) cacheKey(ns, serviceAccount string) string {
+	caHash := sha256.Sum256(v.caCert)
+	return strings.Join(append([]string{ns, serviceAccount, v.addr, hex.EncodeToString(caHash[:]), v.loginPath, v.role}, v.paths...), "\x00")
+}
+
+// allowedVaultAddress tells whether the operator allows sending ServiceAccount tokens to a Vault
+// address with preflight_vault_addresses, the address comes from the pod annotations
+func allowedVaultAddress(addr string) bool {
+	for _, allowed := range parseContainerNames(viper.GetString("preflight_vault_addresses")) {
+		if strings.TrimSuffix(allowed, "/") == strings.TrimSuffix(addr, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePreflightSettings checks the preflight settings at startup: without allowed Vault
+// addresses no pod can be checked, and a typo in the failure policy would reject silently
+func validatePreflightSettings(addresses, policy string) error {
+	var errs []error
+	if len(parseContainerNames(addresses)) == 0 {
+		errs = append(errs, fmt.Errorf("preflight_vault_addresses is empty, list the Vault addresses the ServiceAccount tokens may be sent to"))
+	}
+	switch policy {
+	case preflightFailurePolicyReject, preflightFailurePolicyAdmit:
+	default:
+		errs = append(errs, fmt.Errorf("invalid preflight_failure_policy %q, use %q or %q", policy, preflightFailurePolicyReject, preflightFailurePolicyAdmit))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// vaultLoginPath turns the auth-path annotation, either a login path like
+// auth/kubernetes/cluster-a/login or the mount path of the auth method, into a login path
+func vaultLoginPath(authPath string) string {
+	authPath = strings.Trim(authPath, "/")
+	if authPath == "" {
+		return defaultVaultLoginPath
+	}
+	if !strings.HasPrefix(authPath, "auth/") {
+		authPath = "auth/" + authPath
+	}
+	if !strings.HasSuffix(authPath, "/login") {
+		authPath += "/login"
+	}
+	return authPath
+}
+
+// vaultSecretPaths returns the paths a vault config reads, wildcard paths are not checked
+func vaultSecretPaths(cfg vault) []string {
+	paths := []string{}
+	if cfg.config.path != "" {
+		paths = append(paths, cfg.config.path)
+	}
+	for _, secretConfig := range cfg.config.secretConfigs {
+		var c vaultSecretConfig
+		if err := json.Unmarshal([]byte(secretConfig), &c); err == nil && c.Path != "" {
+			paths = append(paths, c.Path)
+		}
+	}
+
+	checked := paths[:0]
+	for _, p := range paths {
+		if !strings.Contains(p, "*") {
+			checked = append(checked, strings.TrimPrefix(p, "/"))
+		}
+	}
+	return checked
+}
+
+// kv2DataPath returns the path of a KV version 2 secret, the wrapper inserts data/ after the mount
+func kv2DataPath(path string) string {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || strings.HasPrefix(parts[1], "data/") {
+		return path
+	}
+	return parts[0] + "/data/" + parts[1]
+}
+
+// checkVault logs into Vault as the ServiceAccount and checks it can read every path.
+// Results are cached, a failed check for preflight_failure_cache_ttl only
+func (p *preflightChecker) checkVault(ctx context.Context, ns, serviceAccount string, v vaultPreflight) error {
+	if !allowedVaultAddress(v.addr) {
+		return fmt.Errorf("vault address %s is not in preflight_vault_addresses", v.addr)
+	}
+
+	key := v.cacheKey(ns, serviceAccount)
+	if result, ok := p.results.Get(key); ok {
+		if result == nil {
+			return nil
+		}
+		return result.(error)
+	}
+
+	err := p.vaultAccess(ctx, ns, serviceAccount, v)
+	switch {
+	case err == nil:
+		p.results.SetDefault(key, nil)
+	case isAccessDenied(err):
+		p.results.Set(key, err, viper.GetDuration("preflight_failure_cache_ttl"))
+	}
+	return err
+}
+
+func (p *preflightChecker) vaultAccess(ctx context.Context, ns, serviceAccount string, v vaultPreflight) error {
+	expiration := int64(viper.GetDuration("preflight_token_expiration").Seconds())
+	audiences := parseContainerNames(viper.GetString("preflight_token_audiences"))
+	if len(audiences) == 0 {
+		audiences = []string{defaultPreflightTokenAudience}
+	}
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expiration, Audiences: audiences},
+	}
+
+	tokenRequest, err := p.client.CoreV1().ServiceAccounts(ns).CreateToken(serviceAccount, tokenRequest)
+	if err != nil {
+		return fmt.Errorf("cannot request a token for service account %s: %s", serviceAccount, err)
+	}
+
+	client, err := vaultHTTPClient(v.caCert)
+	if err != nil {
+		return err
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err = vaultRequest(ctx, client, v.addr, v.loginPath, "", map[string]string{"role": v.role, "jwt": tokenRequest.Status.Token}, &login)
+	if err != nil {
+		// the login endpoint answers 400 to unknown roles and tokens it does not accept
+		if respErr, ok := err.(*vaultResponseError); ok && respErr.statusCode == http.StatusBadRequest {
+			err = &accessDeniedError{respErr.msg}
+		}
+		if isAccessDenied(err) {
+			return &accessDeniedError{fmt.Sprintf("service account %s cannot log into vault with role %s: %s", serviceAccount, v.role, err)}
+		}
+		return err
+	}
+	token := login.Auth.ClientToken
+
+	defer func() {
+		if err := vaultRequest(context.Background(), client, v.addr, "auth/token/revoke-self", token, nil, nil); err != nil {
+			p.logger.Debugf("Cannot revoke the preflight vault token: %s", err)
+		}
+	}()
+
+	var capabilities map[string]json.RawMessage
+	candidates := []string{}
+	for _, path := range v.paths {
+		candidates = append(candidates, path, kv2DataPath(path))
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if err := vaultRequest(ctx, client, v.addr, "sys/capabilities-self", token, map[string][]string{"paths": candidates}, &capabilities); err != nil {
+		return err
+	}
+	// newer Vault versions also return the response wrapped in data
+	if data, ok := capabilities["data"]; ok {
+		var wrapped map[string]json.RawMessage
+		if err := json.Unmarshal(data, &wrapped); err == nil {
+			capabilities = wrapped
+		}
+	}
+
+	var denied []string
+	for _, path := range v.paths {
+		if !canRead(capabilities, path) && !canRead(capabilities, kv2DataPath(path)) {
+			denied = append(denied, path)
+		}
+	}
+	if len(denied) > 0 {
+		return &accessDeniedError{fmt.Sprintf("vault role %s cannot read %s", v.role, strings.Join(denied, ", "))}
+	}
+	return nil
+}
+
+func canRead(capabilities map[string]json.RawMessage, path string) bool {
+	var caps []string
+	if err := json.Unmarshal(capabilities[path], &caps); err != nil {
+		return false
+	}
+
+	// paths ending with a slash are listed to read every secret under them
+	needed := "read"
+	if strings.HasSuffix(path, "/") {
+		needed = "list"
+	}
+	for _, c := range caps {
+		if c == needed || c == "root" {
+			return true
+		}
+	}
+	return false
+}
+
+func vaultHTTPClient(caCert []byte) (*http.Client, error) {
+	// without a CA the certificate is verified with the system roots, unlike the injected containers
+	tlsConfig := &tls.Config{}
+	if len(caCert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("invalid vault CA certificate")
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}, nil
+}
+
+// vaultRequest sends a request to the Vault HTTP API, 403 responses are access denials
+func vaultRequest(ctx context.Context, client *http.Client, addr, path, token string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach vault at %s: %s", addr, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read the vault response: %s", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		msg := resp.Status
+		if json.Unmarshal(respBody, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			msg = strings.Join(vaultErr.Errors, ", ")
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return &accessDeniedError{msg}
+		}
+		return &vaultResponseError{path, resp.StatusCode, msg}
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// preflightCheck checks that the pod can read the Vault secrets of every container secrets are injected into.
+// Access denials reject the pod, failing to reach Vault applies the preflight_failure_policy
+func (mw *mutatingWebhook) preflightCheck(ctx context.Context, pod *corev1.Pod, smCfg secretManagerConfig, ns string) error {
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("preflight_timeout"))
+	defer cancel()
+
+	checked := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if !isContainerSelected(smCfg, container) {
+			continue
+		}
+
+		cfg := smCfg.forContainer(container.Name).vault
+		// logging in with the GCP auth method needs the credentials of the pod
+		if !cfg.config.enabled || cfg.config.backend == "gcp" {
+			continue
+		}
+
+		v := vaultPreflight{
+			addr:      cfg.config.addr,
+			loginPath: vaultLoginPath(cfg.config.kubernetesBackend),
+			role:      cfg.config.role,
+			paths:     vaultSecretPaths(cfg),
+		}
+		if cfg.config.tlsSecretName != "" {
+			secret, err := mw.getSecret(ctx, cfg.config.tlsSecretName, ns)
+			if err != nil {
+				return &mutationFailure{reasonReference, fmt.Errorf("cannot read the vault TLS secret %s: %s", cfg.config.tlsSecretName, err)}
+			}
+			v.caCert = secret.Data[cfg.config.vaultCACert]
+		}
+
+		key := v.cacheKey(ns, serviceAccount)
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		if err := mw.preflight.checkVault(ctx, ns, serviceAccount, v); err != nil {
+			if isAccessDenied(err) {
+				return &mutationFailure{reasonPreflightDenied, fmt.Errorf("preflight check of container %s failed: %s", container.Name, err)}
+			}
+			if viper.GetString("preflight_failure_policy") != preflightFailurePolicyAdmit {
+				return &mutationFailure{reasonPreflightError, fmt.Errorf("preflight check of container %s could not complete: %s", container.Name, err)}
+			}
+			mw.logger.Warnf("Admitting the pod without a preflight check of container %s: %s", container.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/innovia/secrets-consumer-webhook/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// errNotChecked is the result of the checks that did not complete yet
+var errNotChecked = fmt.Errorf("not checked yet")
+
+// readinessCheck is a dependency the webhook needs to serve admissions. Informational checks
+// are only listed on /readyz?verbose and never fail the probe, as the webhook serves admissions
+// without them
+type readinessCheck struct {
+	name          string
+	check         func(ctx context.Context) error
+	informational bool
+}
+
+// readiness is the state reported by the readiness probe. The checks run in the background
+// every readyz_interval so that the probes do not hit the dependencies, and the probe fails
+// as soon as the webhook starts shutting down so that the pod is removed from the service
+// endpoints before the server stops accepting connections
+type readiness struct {
+	draining      int32
+	checks        []readinessCheck
+	informational map[string]bool
+
+	mu      sync.RWMutex
+	results map[string]error
+}
+
+func newReadiness(checks ...readinessCheck) *readiness {
+	r := &readiness{checks: checks, informational: map[string]bool{}, results: map[string]error{}}
+	for _, c := range checks {
+		r.results[c.name] = errNotChecked
+		r.informational[c.name] = c.informational
+		readinessChecks.WithLabelValues(c.name).Set(0)
+	}
+	return r
+}
+
+func (r *readiness) drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+func (r *readiness) isDraining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+// run runs the checks every readyz_interval until stopCh is closed
+func (r *readiness) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(viper.GetDuration("readyz_interval"))
+	defer ticker.Stop()
+	for {
+		r.runChecks(context.Background())
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runChecks runs every check in parallel, each bounded by readyz_check_timeout
+func (r *readiness) runChecks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range r.checks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			err := runCheck(ctx, c)
+
+			r.mu.Lock()
+			r.results[c.name] = err
+			r.mu.Unlock()
+
+			if err == nil {
+				readinessChecks.WithLabelValues(c.name).Set(1)
+			} else {
+				readinessChecks.WithLabelValues(c.name).Set(0)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// runCheck stops waiting for checks that do not take a context, like the client-go calls, on timeout
+func runCheck(ctx context.Context, c readinessCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("readyz_check_timeout"))
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- c.check(ctx) }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %s", ctx.Err())
+	}
+}
+
+// readyzHandler reports every check in the body, like the Kubernetes API server:
+//
+//	[+]api ok
+//	[-]certificate failed: the serving certificate expires in 2h0m0s
+//
+// the informational checks are only listed with ?verbose
+func (r *readiness) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	_, verbose := req.URL.Query()["verbose"]
+
+	r.mu.RLock()
+	names := make([]string, 0, len(r.results))
+	for name := range r.results {
+		if verbose || !r.informational[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	ready := true
+	for _, name := range names {
+		if err := r.results[name]; err != nil {
+			if !r.informational[name] {
+				ready = false
+			}
+			fmt.Fprintf(&body, "[-]%s failed: %s\n", name, err)
+		} else {
+			fmt.Fprintf(&body, "[+]%s ok\n", name)
+		}
+	}
+	r.mu.RUnlock()
+
+	if r.isDraining() {
+		ready = false
+		body.WriteString("[-]shutdown failed: shutting down\n")
+	} else {
+		body.WriteString("[+]shutdown ok\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if ready {
+		body.WriteString("readyz check passed\n")
+		w.WriteHeader(http.StatusOK)
+	} else {
+		body.WriteString("readyz check failed\n")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(body.Bytes())
+}
+
+// healthzHandler is the liveness probe
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+// apiCheck checks the Kubernetes API can be reached
+func apiCheck(client kubernetes.Interface) readinessCheck {
+	return readinessCheck{name: "api", check: func(context.Context) error {
+		_, err := client.Discovery().ServerVersion()
+		return err
+	}}
+}
+
+// informersCheck checks the ConfigMap and Secret informers have synced
+func informersCheck(references *referenceListers) readinessCheck {
+	return readinessCheck{name: "informers", check: func(context.Context) error {
+		if !references.hasSynced() {
+			return errInformersNotSynced
+		}
+		return nil
+	}}
+}
+
+// certificateCheck checks the serving certificate is loaded and valid for at least readyz_cert_min_validity
+func certificateCheck(certificate func() (*tls.Certificate, error)) readinessCheck {
+	return readinessCheck{name: "certificate", check: func(context.Context) error {
+		cert, err := certificate()
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+
+		remaining := time.Until(leaf.NotAfter)
+		if remaining < viper.GetDuration("readyz_cert_min_validity") {
+			return fmt.Errorf("the serving certificate expires in %s", remaining.Round(time.Second))
+		}
+		return nil
+	}}
+}
+
+// certificateFiles loads the serving certificate from tls_cert_file and tls_private_key_file
+func certificateFiles() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(viper.GetString("tls_cert_file"), viper.GetString("tls_private_key_file"))
+	return &cert, err
+}
+
+// envImageCheck checks the secrets_consumer_env_image can be resolved in the registry, with the
+// secrets_consumer_env_image_pull_secret_name of webhook_namespace. The image cache never expires,
+// so the lookup bypasses it to actually reach the registry.
+//
+// It is informational unless readyz_env_image_gating is set: a registry outage would otherwise
+// take every replica out of the service and fail all the pod admissions, including the pods
+// without secrets, while the webhook can still mutate the pods whose images are cached
+func envImageCheck(client kubernetes.Interface, imageRegistry registry.ImageRegistry, logger log.FieldLogger) readinessCheck {
+	return readinessCheck{name: "env-image", informational: !viper.GetBool("readyz_env_image_gating"), check: func(ctx context.Context) error {
+		container := &corev1.Container{
+			Name:            "secrets-consumer-env",
+			Image:           viper.GetString("secrets_consumer_env_image"),
+			ImagePullPolicy: corev1.PullAlways,
+		}
+		podSpec := &corev1.PodSpec{}
+		if name := viper.GetString("secrets_consumer_env_image_pull_secret_name"); name != "" {
+			podSpec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: name}}
+		}
+
+		if _, err := imageRegistry.GetImageConfig(ctx, logger.WithField("container", container.Name), client, viper.GetString("webhook_namespace"), container, podSpec); err != nil {
+			return fmt.Errorf("cannot resolve %s: %s", container.Image, err)
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+type referenceCacheKey struct{}
+
+// referenceCache memoizes the ConfigMaps and Secrets read during a single admission,
+// so that many env entries referencing the same object cost a single read
+type referenceCache struct {
+	mu         sync.Mutex
+	configMaps map[string]*corev1.ConfigMap
+	secrets    map[string]*corev1.Secret
+	errors     map[string]error
+}
+
+// withReferenceCache returns a context memoizing the references read with it
+func withReferenceCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, referenceCacheKey{}, &referenceCache{
+		configMaps: map[string]*corev1.ConfigMap{},
+		secrets:    map[string]*corev1.Secret{},
+		errors:     map[string]error{},
+	})
+}
+
+func referenceCacheFrom(ctx context.Context) *referenceCache {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(referenceCacheKey{}).(*referenceCache)
+	return c
+}
+
+// referenceListers serves the referenced ConfigMaps and Secrets from shared informers
+type referenceListers struct {
+	configMaps corelisters.ConfigMapLister
+	secrets    corelisters.SecretLister
+	synced     []cache.InformerSynced
+}
+
+// newReferenceListers starts the ConfigMap and Secret informers, optionally limited to the objects
+// matching labelSelector, and waits for them to sync
+func newReferenceListers(client kubernetes.Interface, labelSelector string, stopCh <-chan struct{}) (*referenceListers, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, viper.GetDuration("reference_informers_resync"),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSelector
+		}))
+
+	configMaps := factory.Core().V1().ConfigMaps()
+	secrets := factory.Core().V1().Secrets()
+	listers := &referenceListers{
+		configMaps: configMaps.Lister(),
+		secrets:    secrets.Lister(),
+		synced:     []cache.InformerSynced{configMaps.Informer().HasSynced, secrets.Informer().HasSynced},
+	}
+
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, listers.synced...) {
+		return nil, errInformersNotSynced
+	}
+
+	return listers, nil
+}
+
+// hasSynced reports whether the informers have synced
+func (l *referenceListers) hasSynced() bool {
+	for _, synced := range l.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+var errInformersNotSynced = apierrors.NewServiceUnavailable("the ConfigMap and Secret informers did not sync")
+
+// isTransientError reports whether an API error is worth retrying
+func isTransientError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
+
+// referenceBackoff is the retry policy of the reads of referenced objects. Steps is at least 1,
+// with 0 steps retry.OnError would never call the API and return neither an object nor an error
+func referenceBackoff() wait.Backoff {
+	steps := viper.GetInt("reference_retry_steps")
+	if steps < 1 {
+		steps = 1
+	}
+	return wait.Backoff{
+		Steps:    steps,
+		Duration: 100 * time.Millisecond,
+		Factor:   2.0,
+		Jitter:   0.1,
+	}
+}
+
+// retryReference reads a referenced object, retrying the transient errors until the admission deadline
+func retryReference(ctx context.Context, get func() error) error {
+	return retry.OnError(referenceBackoff(), func(err error) bool {
+		return ctx.Err() == nil && isTransientError(err)
+	}, get)
+}
+
+// referenceAttributes identify the object read by a references.api_get span
+func referenceAttributes(kind, name, ns string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.kind", kind),
+		attribute.String("k8s.name", name),
+		attribute.String("k8s.namespace.name", ns),
+	}
+}
+
+func (mw *mutatingWebhook) getConfigMap(ctx context.Context, name string, ns string) (*corev1.ConfigMap, error) {
+	key := "configmap/" + ns + "/" + name
+	rc := referenceCacheFrom(ctx)
+	if rc != nil {
+		rc.mu.Lock()
+		cm, err := rc.configMaps[key], rc.errors[key]
+		rc.mu.Unlock()
+		if cm != nil || err != nil {
+			recordReference("configmap", "admission_cache", err)
+			return cm, err
+		}
+	}
+
+	var configMap *corev1.ConfigMap
+	var err error
+	if mw.references != nil {
+		configMap, err = mw.references.configMaps.ConfigMaps(ns).Get(name)
+		if err == nil {
+			recordReference("configmap", "informer", nil)
+		}
+	}
+	// objects outside the label selector or created right before the pod are read from the API
+	if mw.references == nil || err != nil {
+		_, span := startSpan(ctx, "references.api_get", referenceAttributes("ConfigMap", name, ns)...)
+		err = retryReference(ctx, func() error {
+			configMap, err = mw.k8sClient.CoreV1().ConfigMaps(ns).Get(name, metav1.GetOptions{})
+			return err
+		})
+		endSpan(span, err)
+		recordReference("configmap", "api", err)
+	}
+
+	if rc != nil {
+		rc.mu.Lock()
+		rc.configMaps[key], rc.errors[key] = configMap, err
+		rc.mu.Unlock()
+	}
+	return configMap, err
+}
+
+func (mw *mutatingWebhook) getSecret(ctx context.Context, name string, ns string) (*corev1.Secret, error) {
+	key := "secret/" + ns + "/" + name
+	rc := referenceCacheFrom(ctx)
+	if rc != nil {
+		rc.mu.Lock()
+		secret, err := rc.secrets[key], rc.errors[key]
+		rc.mu.Unlock()
+		if secret != nil || err != nil {
+			recordReference("secret", "admission_cache", err)
+			return secret, err
+		}
+	}
+
+	var secret *corev1.Secret
+	var err error
+	if mw.references != nil {
+		secret, err = mw.references.secrets.Secrets(ns).Get(name)
+		if err == nil {
+			recordReference("secret", "informer", nil)
+		}
+	}
+	// objects outside the label selector or created right before the pod are read from the API
+	if mw.references == nil || err != nil {
+		_, span := startSpan(ctx, "references.api_get", referenceAttributes("Secret", name, ns)...)
+		err = retryReference(ctx, func() error {
+			secret, err = mw.k8sClient.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+			return err
+		})
+		endSpan(span, err)
+		recordReference("secret", "api", err)
+	}
+
+	if rc != nil {
+		rc.mu.Lock()
+		rc.secrets[key], rc.errors[key] = secret, err
+		rc.mu.Unlock()
+	}
+	return secret, err
+}
@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// identityTokenUsername is the username docker sends along with an identity token
+const identityTokenUsername = "<token>"
+
+// DockerCreds is the content of a .dockerconfigjson secret key
+type DockerCreds struct {
+	Auths map[string]dockerTypes.AuthConfig `json:"auths"`
+}
+
+// parseDockerConfigSecret reads registry credentials from an image pull secret in every format
+// kubelet accepts: kubernetes.io/dockerconfigjson secrets (.dockerconfigjson with an auths wrapper),
+// legacy kubernetes.io/dockercfg secrets (.dockercfg without it) and opaque secrets holding either
+func parseDockerConfigSecret(secret *corev1.Secret) (DockerCreds, error) {
+	var keys []string
+
+	if key := viper.GetString("default_image_pull_docker_config_json_key"); key != "" {
+		keys = append(keys, key)
+	}
+
+	switch secret.Type {
+	case corev1.SecretTypeDockercfg:
+		keys = append(keys, corev1.DockerConfigKey)
+	case corev1.SecretTypeDockerConfigJson:
+		keys = append(keys, corev1.DockerConfigJsonKey)
+	default:
+		keys = append(keys, corev1.DockerConfigJsonKey, corev1.DockerConfigKey)
+	}
+
+	for _, key := range keys {
+		data, ok := secret.Data[key]
+		if !ok {
+			continue
+		}
+		dockerCreds, err := decodeDockerConfig(data)
+		if err != nil {
+			return DockerCreds{}, fmt.Errorf("cannot unmarshal docker configuration from key %s: %s", key, err.Error())
+		}
+		return dockerCreds, nil
+	}
+
+	return DockerCreds{}, fmt.Errorf("secret of type %s has none of the keys %s", secret.Type, strings.Join(keys, ", "))
+}
+
+// decodeDockerConfig accepts both the config.json layout ({"auths": {...}}) and the flat
+// .dockercfg layout where the registries are the top level keys
+func decodeDockerConfig(data []byte) (DockerCreds, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return DockerCreds{}, err
+	}
+
+	if auths, ok := raw["auths"]; ok {
+		var dockerCreds DockerCreds
+		if err := json.Unmarshal(auths, &dockerCreds.Auths); err != nil {
+			return DockerCreds{}, err
+		}
+		return dockerCreds, nil
+	}
+
+	var flat map[string]dockerTypes.AuthConfig
+	if err := json.Unmarshal(data, &flat); err != nil {
+		return DockerCreds{}, err
+	}
+	return DockerCreds{Auths: flat}, nil
+}
+
+// normalizeRegistryKey turns a docker config key into a registry host and optional path,
+// trimming the scheme and the API version suffixes kubectl create secret docker-registry
+// adds for DockerHub
+func normalizeRegistryKey(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	key = strings.TrimSuffix(key, "/")
+	key = strings.TrimSuffix(key, "/v1")
+	key = strings.TrimSuffix(key, "/v2")
+	return strings.TrimSuffix(key, "/")
+}
+
+// matchRegistryKey reports whether a normalized docker config key matches the image,
+// like kubelet keys may use globs in the host, e.g. *.gcr.io
+func matchRegistryKey(key, image string) bool {
+	if !strings.Contains(key, "*") {
+		return image == key || strings.HasPrefix(image, key+"/")
+	}
+
+	keyParts := strings.SplitN(key, "/", 2)
+	imageParts := strings.SplitN(image, "/", 2)
+
+	keyHost := strings.Split(keyParts[0], ".")
+	imageHost := strings.Split(imageParts[0], ".")
+	if len(keyHost) != len(imageHost) {
+		return false
+	}
+	for i := range keyHost {
+		if ok, err := path.Match(keyHost[i], imageHost[i]); err != nil || !ok {
+			return false
+		}
+	}
+
+	if len(keyParts) == 1 {
+		return true
+	}
+	return len(imageParts) == 2 && (imageParts[1] == keyParts[1] || strings.HasPrefix(imageParts[1], keyParts[1]+"/"))
+}
+
+// sortedRegistryKeys returns the keys most specific first, so that the longest match wins
+func sortedRegistryKeys(auths map[string]dockerTypes.AuthConfig) []string {
+	keys := make([]string, 0, len(auths))
+	for key := range auths {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := normalizeRegistryKey(keys[i]), normalizeRegistryKey(keys[j])
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return keys
+}
+
+// registryCredentials extracts the credentials of a docker config entry, in order of precedence
+// username/password, the base64 encoded auth field, an identity token and a registry token
+func registryCredentials(registryName string, registryAuth dockerTypes.AuthConfig) (username string, password string, token string, err error) {
+	switch {
+	case len(registryAuth.Username) > 0 && len(registryAuth.Password) > 0:
+		// auths.<registry>.username and auths.<registry>.password are present
+		// in the config.json, use them
+		return registryAuth.Username, registryAuth.Password, "", nil
+
+	case len(registryAuth.Auth) > 0:
+		// The registry.Auth field contains a base64 encoded string of the format <username>:<password>
+		decodedAuth, err := base64.StdEncoding.DecodeString(registryAuth.Auth)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to decode auth field for registry %s: %s", registryName, err.Error())
+		}
+		// the password may contain colons, only the first one separates it from the username
+		auth := strings.SplitN(string(decodedAuth), ":", 2)
+		if len(auth) != 2 {
+			return "", "", "", fmt.Errorf("unexpected number of elements in auth field for registry %s: %d (expected 2)", registryName, len(auth))
+		}
+		// decodedAuth is something like ":xxx"
+		if len(auth[0]) <= 0 {
+			return "", "", "", fmt.Errorf("username element of auth field for registry %s missing", registryName)
+		}
+		// decodedAuth is something like "xxx:"
+		if len(auth[1]) <= 0 {
+			return "", "", "", fmt.Errorf("password element of auth field for registry %s missing", registryName)
+		}
+		return auth[0], auth[1], "", nil
+
+	case len(registryAuth.IdentityToken) > 0:
+		// identity tokens are exchanged at the token endpoint of the registry like a password
+		username := registryAuth.Username
+		if username == "" {
+			username = identityTokenUsername
+		}
+		return username, registryAuth.IdentityToken, "", nil
+
+	case len(registryAuth.RegistryToken) > 0:
+		return "", "", registryAuth.RegistryToken, nil
+	}
+
+	// the auths section has an entry for the registry, but it contains none of the
+	// supported credentials, fail
+	return "", "", "", fmt.Errorf("found %s in imagePullSecrets but it contains no usable credentials; either username/password, auth, identitytoken or registrytoken fields are required", registryName)
+}
+
+// bearerTransport sends a registry token with every request
+type bearerTransport struct {
+	token     string
+	transport http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,40 @@
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "secrets_consumer_webhook",
+	Subsystem: "registry",
+	Name:      "lookup_duration_seconds",
+	Help:      "Duration of the image config lookups that reached a registry, by registry host and outcome: success or error.",
+	Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16},
+}, []string{"host", "outcome"})
+
+var imageCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Subsystem: "registry",
+	Name:      "image_cache_lookups_total",
+	Help:      "Image config cache lookups, by result: hit, miss or bypass for the images that are never cached (latest tag or Always pull policy).",
+}, []string{"result"})
+
+var ecrTokenRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "secrets_consumer_webhook",
+	Subsystem: "registry",
+	Name:      "ecr_token_refreshes_total",
+	Help:      "ECR authorization token requests made when no cached token was valid, by outcome: success or error.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(lookupDuration)
+	prometheus.MustRegister(imageCacheLookups)
+	prometheus.MustRegister(ecrTokenRefreshes)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const dockerHubHost = "docker.io"
+
+// Mirror maps a source registry to a mirror or pull-through cache,
+// and holds the TLS settings used when talking to it
+type Mirror struct {
+	// Source is the registry host as written in the pod image, e.g. docker.io
+	Source string `json:"source"`
+
+	// Mirror is the registry host and an optional repository prefix to use instead of Source,
+	// e.g. harbor.internal/dockerhub. When empty, only the TLS settings are applied to Source
+	Mirror string `json:"mirror,omitempty"`
+
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `json:"caFile,omitempty"`
+
+	// Insecure disables TLS verification for this registry only
+	Insecure bool `json:"insecure,omitempty"`
+
+	// transport honours CAFile and Insecure, it is built once by LoadMirrors and shared by
+	// every lookup so that the connections are reused. nil means the default transport
+	transport http.RoundTripper
+}
+
+// MirrorsConfig is the content of the file referenced by registry_mirrors_file
+//
+//	registries:
+//	- source: docker.io
+//	  mirror: harbor.internal/dockerhub
+//	  caFile: /etc/registry-ca/harbor.pem
+//	- source: gcr.io
+//	  mirror: mirror.internal/gcr
+//	  insecure: true
+type MirrorsConfig struct {
+	Registries []Mirror `json:"registries"`
+}
+
+// LoadMirrors reads and validates the registry mirrors configuration file,
+// an empty path means no mirrors are configured
+func LoadMirrors(path string) ([]Mirror, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read registry mirrors file: %s", err.Error())
+	}
+
+	var config MirrorsConfig
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse registry mirrors file %s: %s", path, err.Error())
+	}
+
+	seen := map[string]bool{}
+	for i, m := range config.Registries {
+		if m.Source == "" {
+			return nil, fmt.Errorf("registry mirror #%d in %s has no source", i+1, path)
+		}
+		m.Source = normalizeRegistryHost(m.Source)
+		m.Mirror = strings.TrimSuffix(strings.TrimPrefix(m.Mirror, "https://"), "/")
+		if seen[m.Source] {
+			return nil, fmt.Errorf("registry %s is configured more than once in %s", m.Source, path)
+		}
+		seen[m.Source] = true
+
+		if m.transport, err = m.newTransport(); err != nil {
+			return nil, err
+		}
+		config.Registries[i] = m
+	}
+
+	return config.Registries, nil
+}
+
+// normalizeRegistryHost strips the scheme and maps the DockerHub aliases to docker.io
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "https://"), "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return dockerHubHost
+	}
+	return host
+}
+
+// splitImageHost splits an image into its registry host and repository using
+// the same rules as the docker CLI: the first path component is a host only
+// if it contains a '.' or a ':' or is localhost, otherwise the image is on DockerHub
+func splitImageHost(image string) (string, string) {
+	slash := strings.Index(image, "/")
+	if slash == -1 {
+		return dockerHubHost, "library/" + image
+	}
+
+	host := image[:slash]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubHost, image
+	}
+
+	host = normalizeRegistryHost(host)
+	repository := image[slash+1:]
+	if host == dockerHubHost && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return host, repository
+}
+
+// findMirror returns the entry whose source is the given registry host
+func findMirror(mirrors []Mirror, host string) *Mirror {
+	for i := range mirrors {
+		if mirrors[i].Source == host {
+			return &mirrors[i]
+		}
+	}
+	return nil
+}
+
+// findTLSSettings returns the entry holding the TLS settings for a registry host,
+// the host being either the source of an entry or the target of a mirror
+func findTLSSettings(mirrors []Mirror, host string) *Mirror {
+	if m := findMirror(mirrors, host); m != nil {
+		return m
+	}
+	for i := range mirrors {
+		if mirrors[i].Mirror != "" && strings.SplitN(mirrors[i].Mirror, "/", 2)[0] == host {
+			return &mirrors[i]
+		}
+	}
+	return nil
+}
+
+func (m *Mirror) certPool() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	pem, err := ioutil.ReadFile(m.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA bundle for registry %s: %s", m.Source, err.Error())
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s for registry %s contains no PEM certificates", m.CAFile, m.Source)
+	}
+	return pool, nil
+}
+
+// insecureTransport is shared by the registries whose certificate is not verified
+var insecureTransport = func() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+	return transport
+}()
+
+// newTransport builds the http transport of a registry from its CA bundle and insecure flag
+func (m *Mirror) newTransport() (http.RoundTripper, error) {
+	if m.Insecure {
+		return insecureTransport, nil
+	}
+	if m.CAFile == "" {
+		return nil, nil
+	}
+
+	pool, err := m.certPool()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// registryTransport returns the http transport for a registry, the one built for its entry
+// when the mirrors were loaded, and skips the TLS verification of every registry with the
+// global registry_skip_verify
+func registryTransport(m *Mirror, skipVerify bool) http.RoundTripper {
+	switch {
+	case skipVerify:
+		return insecureTransport
+	case m != nil && m.transport != nil:
+		return m.transport
+	default:
+		return http.DefaultTransport
+	}
+}
@@ -15,10 +15,12 @@
 package registry
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
@@ -26,12 +28,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
-	dockerTypes "github.com/docker/docker/api/types"
 	"github.com/heroku/docker-registry-client/registry"
 	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -39,22 +42,18 @@ import (
 
 const ecrCredentialsKey = "AWS_ECR_CREDENTIALS"
 
-var logger *log.Logger
 var ecrHostPattern *regexp.Regexp
 
 func init() {
-	logger = log.New()
-	if viper.GetBool("enable_json_log") {
-		logger.SetFormatter(&log.JSONFormatter{})
-	}
-
 	// Adapted from https://github.com/awslabs/amazon-ecr-credential-helper/blob/master/ecr-login/api/client.go#L34
 	ecrHostPattern = regexp.MustCompile(`([a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.ecr(\-fips)?\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(\.cn)?`)
 }
 
-// ImageRegistry is a docker registry
+// ImageRegistry is a docker registry, the lookups log with the logger of the admission
 type ImageRegistry interface {
 	GetImageConfig(
+		ctx context.Context,
+		logger log.FieldLogger,
 		clientset kubernetes.Interface,
 		namespace string,
 		container *corev1.Container,
@@ -65,18 +64,28 @@ type ImageRegistry interface {
 type Registry struct {
 	imageCache       *cache.Cache
 	credentialsCache *cache.Cache
+	mirrors          []Mirror
+	lookups          singleflight.Group
+	timeout          time.Duration
 }
 
 // NewRegistry creates and initializes registry
-func NewRegistry() ImageRegistry {
+func NewRegistry(logger log.FieldLogger) (ImageRegistry, error) {
+	mirrors, err := LoadMirrors(viper.GetString("registry_mirrors_file"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mirrors {
+		logger.Infof("registry %s is mirrored to %q (caFile: %q, insecure: %t)", m.Source, m.Mirror, m.CAFile, m.Insecure)
+	}
+
 	return &Registry{
 		imageCache:       cache.New(cache.NoExpiration, cache.NoExpiration),
 		credentialsCache: cache.New(12*time.Hour, 12*time.Hour),
-	}
-}
-
-type DockerCreds struct {
-	Auths map[string]dockerTypes.AuthConfig `json:"auths"`
+		mirrors:          mirrors,
+		timeout:          viper.GetDuration("registry_timeout"),
+	}, nil
 }
 
 // IsAllowedToCache checks that information about Docker image can be cached
@@ -91,69 +100,163 @@ func IsAllowedToCache(container *corev1.Container) bool {
 }
 
 // GetImageConfig returns entrypoint and command of container
+//
+// Concurrent lookups of the same image with the same pull secrets share a single
+// registry round trip, which is bounded by registry_timeout. The caller stops
+// waiting as soon as ctx is done.
 func (r *Registry) GetImageConfig(
+	ctx context.Context,
+	logger log.FieldLogger,
 	clientset kubernetes.Interface,
 	namespace string,
 	container *corev1.Container,
-	podSpec *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	podSpec *corev1.PodSpec) (imageConfig *imagev1.ImageConfig, err error) {
+	ctx, span := startSpan(ctx, "registry.get_image_config",
+		attribute.String("container.name", container.Name),
+		attribute.String("container.image", container.Image),
+	)
+	defer func() { endSpan(span, err) }()
+
 	allowToCache := IsAllowedToCache(container)
 	if allowToCache {
 		if imageConfig, cacheHit := r.imageCache.Get(container.Image); cacheHit {
-			logger.Infof("found image %s in cache", container.Image)
+			imageCacheLookups.WithLabelValues("hit").Inc()
+			span.SetAttributes(attribute.String("registry.cache", "hit"))
+			logger.Debugf("Found image %s in cache", container.Image)
 			return imageConfig.(*imagev1.ImageConfig), nil
 		}
+		imageCacheLookups.WithLabelValues("miss").Inc()
+		span.SetAttributes(attribute.String("registry.cache", "miss"))
+	} else {
+		imageCacheLookups.WithLabelValues("bypass").Inc()
+		span.SetAttributes(attribute.String("registry.cache", "bypass"))
+	}
+
+	// the lookup outlives the caller when it is shared, copy what it reads
+	container = container.DeepCopy()
+	podSpec = &corev1.PodSpec{ImagePullSecrets: append([]corev1.LocalObjectReference{}, podSpec.ImagePullSecrets...)}
+
+	result := r.lookups.DoChan(lookupKey(namespace, container, podSpec), func() (interface{}, error) {
+		// the spans and the logs of the registry round trip belong to the admission that started it
+		lookupCtx := detachedContext(ctx)
+		if r.timeout > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(lookupCtx, r.timeout)
+			defer cancel()
+		}
+
+		imageConfig, err := r.getImageConfig(lookupCtx, logger, clientset, namespace, container, podSpec)
+		if imageConfig != nil && allowToCache {
+			r.imageCache.Set(container.Image, imageConfig, cache.DefaultExpiration)
+		}
+		return imageConfig, err
+	})
+
+	select {
+	case res := <-result:
+		span.SetAttributes(attribute.Bool("registry.shared", res.Shared))
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*imagev1.ImageConfig), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting for the image config of %s: %s", container.Image, ctx.Err())
+	}
+}
+
+func (r *Registry) getImageConfig(
+	ctx context.Context,
+	logger log.FieldLogger,
+	clientset kubernetes.Interface,
+	namespace string,
+	container *corev1.Container,
+	podSpec *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	containerInfo := ContainerInfo{Namespace: namespace, clientset: clientset, mirrors: r.mirrors, logger: logger}
+
+	ctx, span := startSpan(ctx, "registry.lookup", attribute.String("container.image", container.Image))
+	start := time.Now()
+	imageConfig, err := r.lookupImageConfig(ctx, &containerInfo, container, podSpec)
+
+	// the host actually contacted, which differs from the host of the image with a mirror
+	host := containerInfo.RegistryName
+	if host == "" {
+		host, _ = splitImageHost(container.Image)
 	}
+	lookupDuration.WithLabelValues(host, outcome(err)).Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.String("registry.host", host))
+	endSpan(span, err)
 
-	containerInfo := ContainerInfo{Namespace: namespace, clientset: clientset}
+	return imageConfig, err
+}
 
-	err := containerInfo.Collect(container, podSpec, r.credentialsCache)
+func (r *Registry) lookupImageConfig(
+	ctx context.Context,
+	containerInfo *ContainerInfo,
+	container *corev1.Container,
+	podSpec *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	err := containerInfo.Collect(ctx, container, podSpec, r.credentialsCache)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Infoln("I'm using registry", containerInfo.RegistryAddress)
+	containerInfo.logger.Infof("Getting the image config of %s from registry %s", container.Image, containerInfo.RegistryAddress)
 
-	imageConfig, err := getImageBlob(containerInfo)
-	if imageConfig != nil && allowToCache {
-		r.imageCache.Set(container.Image, imageConfig, cache.DefaultExpiration)
+	imageConfig, err := getImageBlob(ctx, *containerInfo)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("registry %s did not answer within %s: %s", containerInfo.RegistryAddress, r.timeout, err.Error())
 	}
 
 	return imageConfig, err
 }
 
+// lookupKey identifies lookups that can share the same registry round trip
+func lookupKey(namespace string, container *corev1.Container, podSpec *corev1.PodSpec) string {
+	secrets := make([]string, 0, len(podSpec.ImagePullSecrets))
+	for _, s := range podSpec.ImagePullSecrets {
+		secrets = append(secrets, s.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", namespace, container.Image, strings.Join(secrets, ","))
+}
+
 // GetImageBlob download image blob from registry
-func getImageBlob(container ContainerInfo) (*imagev1.ImageConfig, error) {
+func getImageBlob(ctx context.Context, container ContainerInfo) (*imagev1.ImageConfig, error) {
 	imageName, reference := parseContainerImage(container.Image)
 
-	registrySkipVerify := viper.GetBool("registry_skip_verify")
-
-	var hub *registry.Registry
-	var err error
+	transport := registryTransport(container.tlsSettings(), viper.GetBool("registry_skip_verify"))
 
-	if registrySkipVerify {
-		hub, err = registry.NewInsecure(container.RegistryAddress, container.RegistryUsername, container.RegistryPassword)
-	} else {
-		hub, err = registry.New(container.RegistryAddress, container.RegistryUsername, container.RegistryPassword)
+	if container.RegistryToken != "" {
+		transport = &bearerTransport{token: container.RegistryToken, transport: transport}
 	}
+
+	hub, err := newRegistryClient(container.RegistryAddress, container.RegistryUsername, container.RegistryPassword, &contextTransport{ctx: ctx, transport: transport})
 	if err != nil {
 		return nil, fmt.Errorf("cannot create client for registry: %s", err.Error())
 	}
 
+	_, span := startSpan(ctx, "registry.manifest", attribute.String("image.name", imageName), attribute.String("image.reference", reference))
 	manifest, err := hub.ManifestV2(imageName, reference)
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("cannot download manifest for image: %s", err.Error())
 	}
 
-	reader, err := hub.DownloadBlob(imageName, manifest.Config.Digest)
-	if err != nil {
-		return nil, fmt.Errorf("cannot download blob: %s", err.Error())
-	}
-
-	defer reader.Close()
+	_, span = startSpan(ctx, "registry.blob", attribute.String("image.name", imageName), attribute.String("blob.digest", manifest.Config.Digest.String()))
+	b, err := func() ([]byte, error) {
+		reader, err := hub.DownloadBlob(imageName, manifest.Config.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot download blob: %s", err.Error())
+		}
+		defer reader.Close()
 
-	b, err := ioutil.ReadAll(reader)
+		b, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read blob: %s", err.Error())
+		}
+		return b, nil
+	}()
+	endSpan(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read blob: %s", err.Error())
+		return nil, err
 	}
 
 	var imageMetadata imagev1.Image
@@ -165,6 +268,35 @@ func getImageBlob(container ContainerInfo) (*imagev1.ImageConfig, error) {
 	return &imageMetadata.Config, nil
 }
 
+// newRegistryClient is registry.New with a caller provided transport
+func newRegistryClient(registryURL, username, password string, transport http.RoundTripper) (*registry.Registry, error) {
+	url := strings.TrimSuffix(registryURL, "/")
+	hub := &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: registry.WrapTransport(transport, url, username, password),
+		},
+		Logf: registry.Log,
+	}
+
+	if err := hub.Ping(); err != nil {
+		return nil, err
+	}
+
+	return hub, nil
+}
+
+// contextTransport binds every registry request to the lookup context,
+// the registry client does not take one itself
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
 // parseContainerImage returns image and reference
 func parseContainerImage(image string) (string, string) {
 	var split []string
@@ -194,89 +326,71 @@ type ContainerInfo struct {
 	RegistryName     string
 	RegistryUsername string
 	RegistryPassword string
+	RegistryToken    string
 	Image            string
+	mirrors          []Mirror
+	logger           log.FieldLogger
 }
 
-func (k *ContainerInfo) readDockerSecret(namespace, secretName string) (map[string][]byte, error) {
-	secret, err := k.clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-	return secret.Data, nil
+// tlsSettings returns the configured registry entry for the registry being contacted
+func (k *ContainerInfo) tlsSettings() *Mirror {
+	return findTLSSettings(k.mirrors, normalizeRegistryHost(strings.TrimPrefix(k.RegistryAddress, "https://")))
+}
+
+func (k *ContainerInfo) readDockerSecret(namespace, secretName string) (*corev1.Secret, error) {
+	return k.clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
 }
 
 func (k *ContainerInfo) parseDockerConfig(dockerCreds DockerCreds) (bool, error) {
-	for registryName, registryAuth := range dockerCreds.Auths {
-		if strings.HasPrefix(registryName, "https://") {
-			registryName = strings.TrimPrefix(registryName, "https://")
-		}
+	for _, key := range sortedRegistryKeys(dockerCreds.Auths) {
+		registryAuth := dockerCreds.Auths[key]
+		registryName := normalizeRegistryKey(key)
 
-		// kubectl create secret docker-registry for DockerHub creates
-		// registry credentials with API version suffixes, trim it!
-		if strings.HasSuffix(registryName, "/v1/") {
-			registryName = strings.TrimSuffix(registryName, "/v1/")
-		} else if strings.HasSuffix(registryName, "/v2/") {
-			registryName = strings.TrimSuffix(registryName, "/v2/")
+		// images on DockerHub are resolved to index.docker.io, whatever alias the secret uses
+		if host := strings.SplitN(registryName, "/", 2)[0]; normalizeRegistryHost(host) == dockerHubHost {
+			registryName = "index.docker.io" + strings.TrimPrefix(registryName, host)
 		}
 
-		registryName = strings.TrimSuffix(registryName, "/")
+		if !matchRegistryKey(registryName, k.Image) {
+			continue
+		}
 
-		if strings.HasPrefix(k.Image, registryName) {
-			k.RegistryName = registryName
-			if registryAuth.ServerAddress != "" {
-				k.RegistryAddress = registryAuth.ServerAddress
-			} else {
-				k.RegistryAddress = fmt.Sprintf("https://%s", registryName)
-			}
-			if len(registryAuth.Username) > 0 && len(registryAuth.Password) > 0 {
-				// auths.<registry>.username and auths.<registry>.username are present
-				// in the config.json, use them
-				k.RegistryUsername = registryAuth.Username
-				k.RegistryPassword = registryAuth.Password
-			} else if len(registryAuth.Auth) > 0 {
-				// auths.<registry>.username and auths.<registry>.username are not present
-				// in the config.json, fall back to the base64 encoded auths.<registry>.auth field
-				// The registry.Auth field contains a base64 encoded string of the format <username>:<password>
-				decodedAuth, err := base64.StdEncoding.DecodeString(registryAuth.Auth)
-				if err != nil {
-					return false, fmt.Errorf("failed to decode auth field for registry %s: %s", registryName, err.Error())
-				}
-				auth := strings.Split(string(decodedAuth), ":")
-				if len(auth) != 2 {
-					return false, fmt.Errorf("unexpected number of elements in auth field for registry %s: %d (expected 2)", registryName, len(auth))
-				}
-				// decodedAuth is something like ":xxx"
-				if len(auth[0]) <= 0 {
-					return false, fmt.Errorf("username element of auth field for registry %s missing", registryName)
-				}
-				// decodedAuth is something like "xxx:"
-				if len(auth[1]) <= 0 {
-					return false, fmt.Errorf("password element of auth field for registry %s missing", registryName)
-				}
-				k.RegistryUsername = auth[0]
-				k.RegistryPassword = auth[1]
-			} else {
-				// the auths section has an entry for the registry, but it neither contains
-				// username/password fields nor an auth field, fail
-				return false, fmt.Errorf("found %s in imagePullSecrets but it contains no usable credentials; either username/password fields or an auth field are required", registryName)
-			}
+		username, password, token, err := registryCredentials(registryName, registryAuth)
+		if err != nil {
+			return false, err
+		}
 
-			return true, nil
+		// the registry of a glob key is the host of the image itself
+		k.RegistryName = strings.SplitN(k.Image, "/", 2)[0]
+		if !strings.Contains(registryName, "*") {
+			k.RegistryName = strings.SplitN(registryName, "/", 2)[0]
 		}
+		if registryAuth.ServerAddress != "" {
+			k.RegistryAddress = registryAuth.ServerAddress
+		} else {
+			k.RegistryAddress = fmt.Sprintf("https://%s", k.RegistryName)
+		}
+		k.RegistryUsername = username
+		k.RegistryPassword = password
+		k.RegistryToken = token
+
+		return true, nil
 	}
 
 	return false, nil
 }
 
-func (k *ContainerInfo) fixDockerHubImage(image string) string {
-	slash := strings.Index(image, "/")
-	if slash == -1 { // Is it a DockerHub library repository?
-		image = "index.docker.io/library/" + image
-	} else if !strings.Contains(image[:slash], ".") { // DockerHub organization names can't contain '.'
-		image = "index.docker.io/" + image
-	} else if strings.HasPrefix(image, "docker.io/") {
-		image = "index." + image
-	} else {
+// resolveImage returns the fully qualified image, rewritten to its mirror if the
+// registry of the image has one configured
+func (k *ContainerInfo) resolveImage(image string) string {
+	host, repository := splitImageHost(image)
+
+	if m := findMirror(k.mirrors, host); m != nil && m.Mirror != "" {
+		k.logger.Infof("rewriting image %s to mirror %s", image, m.Mirror)
+		return m.Mirror + "/" + repository
+	}
+
+	if host != dockerHubHost {
 		return image
 	}
 
@@ -284,21 +398,18 @@ func (k *ContainerInfo) fixDockerHubImage(image string) string {
 	k.RegistryAddress = "https://index.docker.io"
 	k.RegistryName = "index.docker.io"
 
-	return image
+	return "index.docker.io/" + repository
 }
 
 func (k *ContainerInfo) checkImagePullSecret(namespace string, secret string) (bool, error) {
-	data, err := k.readDockerSecret(namespace, secret)
+	pullSecret, err := k.readDockerSecret(namespace, secret)
 	if err != nil {
 		return false, fmt.Errorf("cannot read imagePullSecret '%s' in namespace '%s': %s", secret, namespace, err.Error())
 	}
 
-	var dockerCreds DockerCreds
-
-	dockerConfigJSONKey := viper.GetString("default_image_pull_docker_config_json_key")
-	err = json.Unmarshal(data[dockerConfigJSONKey], &dockerCreds)
+	dockerCreds, err := parseDockerConfigSecret(pullSecret)
 	if err != nil {
-		return false, fmt.Errorf("cannot unmarshal docker configuration from imagePullSecret: %s", err.Error())
+		return false, fmt.Errorf("cannot read docker configuration from imagePullSecret '%s' in namespace '%s': %s", secret, namespace, err.Error())
 	}
 
 	found, err := k.parseDockerConfig(dockerCreds)
@@ -306,8 +417,8 @@ func (k *ContainerInfo) checkImagePullSecret(namespace string, secret string) (b
 }
 
 // Collect reads information from k8s and load them into the structure
-func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.PodSpec, credentialsCache *cache.Cache) error {
-	k.Image = k.fixDockerHubImage(container.Image)
+func (k *ContainerInfo) Collect(ctx context.Context, container *corev1.Container, podSpec *corev1.PodSpec, credentialsCache *cache.Cache) error {
+	k.Image = k.resolveImage(container.Image)
 
 	var err error
 	found := false
@@ -322,7 +433,7 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 		}
 
 		if found {
-			logger.Infof("found credentials for registry %s in pod imagePullSecret: %s/%s", k.RegistryName, k.Namespace, imagePullSecret.Name)
+			k.logger.Infof("found credentials for registry %s in pod imagePullSecret: %s/%s", k.RegistryName, k.Namespace, imagePullSecret.Name)
 			break
 		}
 	}
@@ -339,14 +450,14 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 			}
 
 			if found {
-				logger.Infof("found credentials for registry %s in default imagePullSecret: %s/%s", k.RegistryName, defaultImagePullSecretNamespace, defaultImagePullSecret)
+				k.logger.Infof("found credentials for registry %s in default imagePullSecret: %s/%s", k.RegistryName, defaultImagePullSecretNamespace, defaultImagePullSecret)
 			}
 		}
 	}
 
 	// In case of other docker registry
 	if k.RegistryName == "" && k.RegistryAddress == "" {
-		registryName := container.Image
+		registryName := k.Image
 		if strings.HasPrefix(registryName, "https://") {
 			registryName = strings.TrimPrefix(registryName, "https://")
 		}
@@ -362,18 +473,18 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 	if !found {
 		// if still no credentials and it is an ECR image, try to get credentials through an EC2 instance role
 		if ecrRegistryID, region := getECRRegistryIDAndRegion(k.RegistryAddress); ecrRegistryID != "" {
-			logger.Infof("trying to request AWS credentials for ECR registry %s", k.RegistryAddress)
+			k.logger.Infof("trying to request AWS credentials for ECR registry %s", k.RegistryAddress)
 
 			var data string
 			cacheKey := ecrCredentialsKey + k.RegistryAddress
 			cachedToken, usingCache := credentialsCache.Get(cacheKey)
 			if usingCache {
 				data = cachedToken.(string)
-				logger.Infof("Using cached AWS ECR Token for registry %s", k.RegistryAddress)
+				k.logger.Infof("Using cached AWS ECR Token for registry %s", k.RegistryAddress)
 			} else {
 				sess, err := session.NewSession()
 				if err != nil {
-					logger.Info("Failed to create AWS session, trying with no credentials")
+					k.logger.Info("Failed to create AWS session, trying with no credentials")
 					return nil
 				}
 				svc := ecr.New(sess, aws.NewConfig().WithRegion(region))
@@ -382,9 +493,10 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 					RegistryIds: []*string{aws.String(ecrRegistryID)},
 				}
 
-				resp, err := svc.GetAuthorizationToken(&req)
+				resp, err := svc.GetAuthorizationTokenWithContext(ctx, &req)
+				ecrTokenRefreshes.WithLabelValues(outcome(err)).Inc()
 				if err != nil {
-					logger.Infof("Failed to get AWS ECR Token, trying with no credentials")
+					k.logger.Infof("Failed to get AWS ECR Token, trying with no credentials")
 					return nil
 				}
 
@@ -399,7 +511,7 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 
 				expiration := authData.ExpiresAt.Sub(time.Now().Add(5 * time.Minute))
 				credentialsCache.Set(cacheKey, data, expiration)
-				logger.Infof("Caching ECR token with expiration in %+v", expiration)
+				k.logger.Infof("Caching ECR token with expiration in %+v", expiration)
 			}
 
 			token := strings.SplitN(data, ":", 2)
@@ -407,9 +519,9 @@ func (k *ContainerInfo) Collect(container *corev1.Container, podSpec *corev1.Pod
 			k.RegistryUsername = token[0]
 			k.RegistryPassword = token[1]
 
-			logger.Infof("got AWS credentials for ecr registry %s", k.RegistryAddress)
+			k.logger.Infof("got AWS credentials for ecr registry %s", k.RegistryAddress)
 		} else {
-			logger.Infof("found no credentials for registry %s, assuming it is public", k.RegistryAddress)
+			k.logger.Infof("found no credentials for registry %s, assuming it is public", k.RegistryAddress)
 		}
 	}
 
@@ -15,12 +15,34 @@
 package registry
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestIsAllowedToCache(t *testing.T) {
@@ -124,10 +146,10 @@ func TestParsingRegistryAddress(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		containerInfo := ContainerInfo{}
+		containerInfo := ContainerInfo{logger: log.New()}
 		mockCache := cache.New(time.Minute, time.Minute)
 
-		err := containerInfo.Collect(test.container, test.podSpec, mockCache)
+		err := containerInfo.Collect(context.Background(), test.container, test.podSpec, mockCache)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -135,3 +157,506 @@ func TestParsingRegistryAddress(t *testing.T) {
 		assert.Equal(t, test.registryAddress, containerInfo.RegistryAddress)
 	}
 }
+
+func TestMirrorRewrite(t *testing.T) {
+	mirrors := []Mirror{
+		{Source: "docker.io", Mirror: "harbor.internal/dockerhub"},
+		{Source: "gcr.io", Mirror: "mirror.internal:5000/gcr", Insecure: true},
+		{Source: "quay.io", CAFile: "/etc/ca/quay.pem"},
+	}
+
+	tests := []struct {
+		image           string
+		registryAddress string
+		repository      string
+		insecure        bool
+	}{
+		{
+			image:           "foo:bar",
+			registryAddress: "https://harbor.internal",
+			repository:      "dockerhub/library/foo:bar",
+		},
+		{
+			image:           "docker.io/org/foo:bar",
+			registryAddress: "https://harbor.internal",
+			repository:      "dockerhub/org/foo:bar",
+		},
+		{
+			image:           "index.docker.io/foo",
+			registryAddress: "https://harbor.internal",
+			repository:      "dockerhub/library/foo",
+		},
+		{
+			image:           "gcr.io/project/app:1.0",
+			registryAddress: "https://mirror.internal:5000",
+			repository:      "gcr/project/app:1.0",
+			insecure:        true,
+		},
+		{
+			image:           "quay.io/org/app:1.0",
+			registryAddress: "https://quay.io",
+			repository:      "org/app:1.0",
+		},
+		{
+			image:           "docker.pkg.github.com/banzaicloud/bank-vaults/vault-env:0.6.0",
+			registryAddress: "https://docker.pkg.github.com",
+			repository:      "banzaicloud/bank-vaults/vault-env:0.6.0",
+		},
+	}
+
+	for _, test := range tests {
+		containerInfo := ContainerInfo{mirrors: mirrors, logger: log.New()}
+		mockCache := cache.New(time.Minute, time.Minute)
+
+		err := containerInfo.Collect(context.Background(), &corev1.Container{Image: test.image}, &corev1.PodSpec{}, mockCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, test.registryAddress, containerInfo.RegistryAddress, test.image)
+		assert.Equal(t, test.repository, containerInfo.Image, test.image)
+
+		tls := containerInfo.tlsSettings()
+		assert.Equal(t, test.insecure, tls != nil && tls.Insecure, test.image)
+	}
+}
+
+func TestLoadMirrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Mirror
+		wantErr bool
+	}{
+		{
+			name: "normalizes hosts",
+			content: `
+registries:
+- source: https://index.docker.io/
+  mirror: https://harbor.internal/dockerhub/
+- source: gcr.io
+  mirror: mirror.internal/gcr
+  insecure: true
+`,
+			want: []Mirror{
+				{Source: "docker.io", Mirror: "harbor.internal/dockerhub"},
+				{Source: "gcr.io", Mirror: "mirror.internal/gcr", Insecure: true, transport: insecureTransport},
+			},
+		},
+		{
+			name: "duplicate source",
+			content: `
+registries:
+- source: docker.io
+  mirror: a.internal
+- source: index.docker.io
+  mirror: b.internal
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown field",
+			content: `
+registries:
+- source: docker.io
+  mirrors: a.internal
+`,
+			wantErr: true,
+		},
+		{
+			name: "missing CA bundle",
+			content: `
+registries:
+- source: docker.io
+  caFile: /does/not/exist.pem
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "mirrors-*.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString(test.content); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			got, err := LoadMirrors(f.Name())
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestRegistryTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ca, err := ioutil.TempFile("", "registry-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	if err := pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	ca.Close()
+
+	config, err := ioutil.TempFile("", "mirrors-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	if _, err := config.WriteString("registries:\n- source: registry.internal\n  caFile: " + ca.Name() + "\n- source: docker.io\n  mirror: harbor.internal\n"); err != nil {
+		t.Fatal(err)
+	}
+	config.Close()
+
+	mirrors, err := LoadMirrors(config.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := registryTransport(findTLSSettings(mirrors, "registry.internal"), false)
+	if transport == http.DefaultTransport {
+		t.Fatal("expected a transport trusting the CA bundle")
+	}
+	assert.True(t, transport == registryTransport(findTLSSettings(mirrors, "registry.internal"), false), "expected the transport to be reused")
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the CA bundle to be trusted: %s", err)
+	}
+	resp.Body.Close()
+
+	assert.True(t, registryTransport(findTLSSettings(mirrors, "docker.io"), false) == http.DefaultTransport)
+	assert.True(t, registryTransport(nil, false) == http.DefaultTransport)
+	assert.True(t, registryTransport(findTLSSettings(mirrors, "registry.internal"), true) == insecureTransport)
+}
+
+func TestImagePullSecretFormats(t *testing.T) {
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("user:pa:ss"))
+
+	tests := []struct {
+		name             string
+		image            string
+		secret           *corev1.Secret
+		registryAddress  string
+		registryUsername string
+		registryPassword string
+		registryToken    string
+		wantErr          bool
+	}{
+		{
+			name:  "dockerconfigjson with username and password",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"registry.example.com": {"username": "user", "password": "pass"}}}`),
+				},
+			},
+			registryAddress:  "https://registry.example.com",
+			registryUsername: "user",
+			registryPassword: "pass",
+		},
+		{
+			name:  "dockerconfigjson with auth containing a colon in the password",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"https://registry.example.com/v2/": {"auth": "` + basicAuth + `"}}}`),
+				},
+			},
+			registryAddress:  "https://registry.example.com",
+			registryUsername: "user",
+			registryPassword: "pa:ss",
+		},
+		{
+			name:  "legacy dockercfg without the auths wrapper",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockercfg,
+				Data: map[string][]byte{
+					corev1.DockerConfigKey: []byte(`{"registry.example.com": {"auth": "` + basicAuth + `", "email": "me@example.com"}}`),
+				},
+			},
+			registryAddress:  "https://registry.example.com",
+			registryUsername: "user",
+			registryPassword: "pa:ss",
+		},
+		{
+			name:  "opaque secret holding a dockercfg",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					corev1.DockerConfigKey: []byte(`{"registry.example.com": {"username": "user", "password": "pass"}}`),
+				},
+			},
+			registryAddress:  "https://registry.example.com",
+			registryUsername: "user",
+			registryPassword: "pass",
+		},
+		{
+			name:  "identity token",
+			image: "myregistry.azurecr.io/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"myregistry.azurecr.io": {"identitytoken": "refresh-token"}}}`),
+				},
+			},
+			registryAddress:  "https://myregistry.azurecr.io",
+			registryUsername: "<token>",
+			registryPassword: "refresh-token",
+		},
+		{
+			name:  "registry token",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"registry.example.com": {"registrytoken": "bearer-token"}}}`),
+				},
+			},
+			registryAddress: "https://registry.example.com",
+			registryToken:   "bearer-token",
+		},
+		{
+			name:  "DockerHub legacy key matches images without a registry",
+			image: "org/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"https://index.docker.io/v1/": {"username": "user", "password": "pass"}}}`),
+				},
+			},
+			registryAddress:  "https://index.docker.io",
+			registryUsername: "user",
+			registryPassword: "pass",
+		},
+		{
+			name:  "glob key",
+			image: "eu.gcr.io/project/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"*.gcr.io": {"username": "_json_key", "password": "{}"}}}`),
+				},
+			},
+			registryAddress:  "https://eu.gcr.io",
+			registryUsername: "_json_key",
+			registryPassword: "{}",
+		},
+		{
+			name:  "longest key wins",
+			image: "registry.example.com/team/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"registry.example.com": {"username": "user", "password": "pass"}, "registry.example.com/team": {"username": "team", "password": "secret"}}}`),
+				},
+			},
+			registryAddress:  "https://registry.example.com",
+			registryUsername: "team",
+			registryPassword: "secret",
+		},
+		{
+			name:  "entry without credentials",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"registry.example.com": {"email": "me@example.com"}}}`),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:  "dockerconfigjson secret without its key",
+			image: "registry.example.com/app:1.0",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigKey: []byte(`{}`),
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.secret.Name = "pull-secret"
+			test.secret.Namespace = "default"
+
+			containerInfo := ContainerInfo{Namespace: "default", clientset: fake.NewSimpleClientset(test.secret), logger: log.New()}
+			podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "pull-secret"}}}
+
+			err := containerInfo.Collect(context.Background(), &corev1.Container{Image: test.image}, podSpec, cache.New(time.Minute, time.Minute))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.registryAddress, containerInfo.RegistryAddress)
+			assert.Equal(t, test.registryUsername, containerInfo.RegistryUsername)
+			assert.Equal(t, test.registryPassword, containerInfo.RegistryPassword)
+			assert.Equal(t, test.registryToken, containerInfo.RegistryToken)
+		})
+	}
+}
+
+// newFakeRegistry serves the image app:1.0 with the /app entrypoint
+func newFakeRegistry() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/app/manifests/1.0":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			_, _ = w.Write([]byte(`{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000"}}`))
+		case "/v2/app/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000":
+			_, _ = w.Write([]byte(`{"config": {"Entrypoint": ["/app"]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestGetImageConfigMetrics(t *testing.T) {
+	server := newFakeRegistry()
+	defer server.Close()
+
+	viper.Set("registry_skip_verify", true)
+	defer viper.Set("registry_skip_verify", false)
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	r := &Registry{imageCache: cache.New(cache.NoExpiration, cache.NoExpiration), credentialsCache: cache.New(time.Hour, time.Hour)}
+
+	hits := testutil.ToFloat64(imageCacheLookups.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(imageCacheLookups.WithLabelValues("miss"))
+	bypasses := testutil.ToFloat64(imageCacheLookups.WithLabelValues("bypass"))
+
+	for _, container := range []*corev1.Container{
+		{Image: host + "/app:1.0"},
+		{Image: host + "/app:1.0"},
+		{Image: host + "/app:1.0", ImagePullPolicy: corev1.PullAlways},
+		{Image: host + "/missing:1.0"},
+	} {
+		_, _ = r.GetImageConfig(context.Background(), log.New(), fake.NewSimpleClientset(), "default", container, &corev1.PodSpec{})
+	}
+
+	assert.Equal(t, hits+1, testutil.ToFloat64(imageCacheLookups.WithLabelValues("hit")))
+	assert.Equal(t, misses+2, testutil.ToFloat64(imageCacheLookups.WithLabelValues("miss")))
+	assert.Equal(t, bypasses+1, testutil.ToFloat64(imageCacheLookups.WithLabelValues("bypass")))
+
+	// the histogram of a host and outcome is a single collector, count its samples
+	assert.Equal(t, 2, histogramCount(t, lookupDuration.WithLabelValues(host, "success")))
+	assert.Equal(t, 1, histogramCount(t, lookupDuration.WithLabelValues(host, "error")))
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) int {
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return int(m.GetHistogram().GetSampleCount())
+}
+
+func TestGetImageConfigTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	server := newFakeRegistry()
+	defer server.Close()
+
+	viper.Set("registry_skip_verify", true)
+	defer viper.Set("registry_skip_verify", false)
+
+	r := &Registry{imageCache: cache.New(cache.NoExpiration, cache.NoExpiration), credentialsCache: cache.New(time.Hour, time.Hour)}
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{UID: "trace-uid"})
+	container := &corev1.Container{Name: "app", Image: strings.TrimPrefix(server.URL, "https://") + "/app:1.0"}
+
+	_, err := r.GetImageConfig(ctx, log.New(), fake.NewSimpleClientset(), "default", container, &corev1.PodSpec{})
+	assert.NoError(t, err)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	assert.Len(t, spans, 4)
+
+	// the manifest and blob downloads are children of the lookup, in the trace of the admission
+	root := spans["registry.get_image_config"]
+	assert.Equal(t, root.SpanContext.SpanID(), spans["registry.lookup"].Parent.SpanID())
+	for _, name := range []string{"registry.manifest", "registry.blob"} {
+		assert.Equal(t, spans["registry.lookup"].SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+		assert.Equal(t, root.SpanContext.TraceID(), spans[name].SpanContext.TraceID(), name)
+	}
+	for name, span := range spans {
+		assert.Contains(t, span.Attributes, attribute.String("admission.uid", "trace-uid"), name)
+	}
+	assert.Contains(t, root.Attributes, attribute.String("registry.cache", "miss"))
+}
+
+func TestGetImageConfigLogger(t *testing.T) {
+	server := newFakeRegistry()
+	defer server.Close()
+
+	viper.Set("registry_skip_verify", true)
+	defer viper.Set("registry_skip_verify", false)
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+	r := &Registry{imageCache: cache.New(cache.NoExpiration, cache.NoExpiration), credentialsCache: cache.New(time.Hour, time.Hour)}
+	container := &corev1.Container{Name: "app", Image: strings.TrimPrefix(server.URL, "https://") + "/app:1.0"}
+
+	for i := 0; i < 2; i++ {
+		_, err := r.GetImageConfig(context.Background(), logger.WithFields(log.Fields{"admission_uid": "log-uid", "container": "app"}),
+			fake.NewSimpleClientset(), "default", container, &corev1.PodSpec{})
+		assert.NoError(t, err)
+	}
+
+	// the lookup and the cache hit both log with the fields of the admission
+	assert.NotEmpty(t, hook.AllEntries())
+	for _, entry := range hook.AllEntries() {
+		assert.Equal(t, "log-uid", entry.Data["admission_uid"], entry.Message)
+		assert.Equal(t, "app", entry.Data["container"], entry.Message)
+	}
+	assert.Contains(t, hook.LastEntry().Message, "in cache")
+}
+
+func TestGetImageConfigTimeout(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	viper.Set("registry_skip_verify", true)
+	defer viper.Set("registry_skip_verify", false)
+
+	// the error reports the timeout of the registry, not the one configured since it was created
+	viper.Set("registry_timeout", "1m")
+	defer viper.Set("registry_timeout", "")
+
+	r := &Registry{imageCache: cache.New(cache.NoExpiration, cache.NoExpiration), credentialsCache: cache.New(time.Hour, time.Hour), timeout: 50 * time.Millisecond}
+	container := &corev1.Container{Name: "app", Image: strings.TrimPrefix(server.URL, "https://") + "/app:1.0"}
+
+	_, err := r.GetImageConfig(context.Background(), log.New(), fake.NewSimpleClientset(), "default", container, &corev1.PodSpec{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not answer within 50ms")
+	}
+}
@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"context"
+
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/innovia/secrets-consumer-webhook/registry"
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		attrs = append(attrs, attribute.String("admission.uid", string(ar.UID)))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// detachedContext keeps the trace and the admission request of ctx, but not its deadline, for
+// the lookups shared by several callers
+func detachedContext(ctx context.Context) context.Context {
+	detached := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		detached = whcontext.SetAdmissionRequest(detached, ar)
+	}
+	return detached
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/appscode/jsonpatch"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// stringsFlag is a flag that can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// renderCommand runs the SecretsMutator on the manifests of a file or stdin without a cluster,
+// and prints the mutated objects or the JSON patches the webhook would answer. The referenced
+// ConfigMaps and Secrets are read from the manifests themselves and the --resources files, the
+// entrypoints of the images from the --images file and the --oci-layout directories
+func renderCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	filename := flags.String("f", "-", "manifest of the Pods and workloads to render, - for stdin")
+	namespace := flags.String("namespace", "default", "namespace of the objects without one")
+	output := flags.String("output", "object", "print the mutated objects as YAML (object) or the JSON patches (patch)")
+	images := flags.String("images", "", "YAML list of the entrypoint and cmd of the images, [{image: app:1.0, entrypoint: [/app], cmd: [serve]}]")
+	logLevel := flags.String("log-level", "warning", "level of the logs written to stderr")
+	var resources, layouts stringsFlag
+	flags.Var(&resources, "resources", "manifest of the referenced ConfigMaps and Secrets, can be repeated")
+	flags.Var(&layouts, "oci-layout", "image=directory of an OCI image layout the image config is read from, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s render [flags]\n\nRenders the pods as the webhook mutates them, without a cluster.\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "object" && *output != "patch" {
+		fmt.Fprintf(stderr, "invalid output %q, expected object or patch\n", *output)
+		return 2
+	}
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	logger := newLogger()
+	logger.SetOutput(stderr)
+	logger.SetLevel(level)
+
+	docs, err := readManifestFile(*filename, stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	referenced := append([]manifestDocument{}, docs...)
+	for _, file := range resources {
+		resourceDocs, err := readManifestFile(file, stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		referenced = append(referenced, resourceDocs...)
+	}
+	client, err := localClient(referenced, *namespace)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	imageRegistry, err := newLocalRegistry(*images, layouts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	mw := &mutatingWebhook{k8sClient: client, registry: imageRegistry, logger: logger}
+
+	failed := false
+	for i, doc := range docs {
+		original, mutated, err := mw.render(i, doc.data, *namespace)
+		if err != nil {
+			fmt.Fprintf(stderr, "document %d: %s\n", i+1, err)
+			failed = true
+			continue
+		}
+
+		if *output == "patch" {
+			patch, err := jsonpatch.CreatePatch(original, mutated)
+			if err == nil {
+				var line []byte
+				if line, err = json.Marshal(patch); err == nil {
+					fmt.Fprintf(stdout, "%s\n", line)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "document %d: cannot create the patch: %s\n", i+1, err)
+				failed = true
+			}
+			continue
+		}
+
+		object, err := yaml.JSONToYAML(mutated)
+		if err != nil {
+			fmt.Fprintf(stderr, "document %d: %s\n", i+1, err)
+			failed = true
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(stdout, "---")
+		}
+		fmt.Fprintf(stdout, "%s", object)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// render mutates a Pod, or the pod template of a workload as the pods it creates will be mutated,
+// and returns the JSON of the object before and after. The other objects are left as they are
+func (mw *mutatingWebhook) render(i int, doc []byte, namespace string) ([]byte, []byte, error) {
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+	if k8sruntime.IsNotRegisteredError(err) || k8sruntime.IsMissingKind(err) {
+		return doc, doc, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decode the object: %s", err)
+	}
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return doc, doc, nil
+	}
+
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ns := meta.GetNamespace()
+	if ns == "" {
+		ns = namespace
+	}
+
+	var pod *corev1.Pod
+	template := podTemplateSpec(meta)
+	switch {
+	case template != nil:
+		pod = &corev1.Pod{ObjectMeta: *template.ObjectMeta.DeepCopy(), Spec: *template.Spec.DeepCopy()}
+		pod.GenerateName = meta.GetName() + "-"
+	case gvk.Kind == "Pod":
+		pod = obj.(*corev1.Pod)
+	default:
+		return doc, doc, nil
+	}
+	pod.Namespace = ns
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{
+		UID:       types.UID(fmt.Sprintf("render-%d", i+1)),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: ns,
+		Name:      pod.Name,
+		Operation: admissionv1beta1.Create,
+	})
+	if _, err := mw.SecretsMutator(ctx, pod); err != nil {
+		return nil, nil, fmt.Errorf("%s %s: %s", gvk.Kind, meta.GetName(), err)
+	}
+
+	if template != nil {
+		pod.Namespace, pod.GenerateName = template.Namespace, template.GenerateName
+		template.ObjectMeta, template.Spec = pod.ObjectMeta, pod.Spec
+	}
+
+	mutated, err := json.Marshal(obj)
+	return original, mutated, err
+}
+
+// manifestDocument is a document of a manifest, in JSON, and the line it starts at
+type manifestDocument struct {
+	data []byte
+	line int
+}
+
+// readManifestFile reads the documents of a YAML or JSON file, or of stdin for -
+func readManifestFile(filename string, stdin io.Reader) ([]manifestDocument, error) {
+	r := stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	docs, err := readManifests(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", filename, err)
+	}
+	return docs, nil
+}
+
+// readManifests splits a stream of YAML documents separated by --- lines, or a JSON object,
+// into the JSON of each document, skipping the empty ones
+func readManifests(r io.Reader) ([]manifestDocument, error) {
+	reader := bufio.NewReader(r)
+
+	var docs []manifestDocument
+	var current bytes.Buffer
+	line, start := 0, 0
+	flush := func() error {
+		defer current.Reset()
+		data, err := yaml.YAMLToJSON(current.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: %s", start, err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 || bytes.Equal(data, []byte("null")) {
+			return nil
+		}
+		docs = append(docs, manifestDocument{data: data, line: start})
+		return nil
+	}
+
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if text != "" {
+			line++
+			if strings.HasPrefix(text, "---") && strings.TrimSpace(text[3:]) == "" {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				start = 0
+			} else {
+				// a document starts at its first line that is not blank or a comment
+				if trimmed := strings.TrimSpace(text); start == 0 && trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+					start = line
+				}
+				current.WriteString(text)
+			}
+		}
+		if err == io.EOF {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			return docs, nil
+		}
+	}
+}
+
+// localClient serves the ConfigMaps and Secrets of the documents as the API would. The other
+// objects are ignored
+func localClient(docs []manifestDocument, namespace string) (kubernetes.Interface, error) {
+	var objects []k8sruntime.Object
+	for _, doc := range docs {
+		var typeMeta metav1.TypeMeta
+		if err := json.Unmarshal(doc.data, &typeMeta); err != nil || typeMeta.APIVersion != "v1" {
+			continue
+		}
+
+		switch typeMeta.Kind {
+		case "ConfigMap":
+			configMap := &corev1.ConfigMap{}
+			if err := json.Unmarshal(doc.data, configMap); err != nil {
+				return nil, fmt.Errorf("cannot decode ConfigMap: %s", err)
+			}
+			if configMap.Namespace == "" {
+				configMap.Namespace = namespace
+			}
+			objects = append(objects, configMap)
+		case "Secret":
+			secret := &corev1.Secret{}
+			if err := json.Unmarshal(doc.data, secret); err != nil {
+				return nil, fmt.Errorf("cannot decode Secret: %s", err)
+			}
+			if secret.Namespace == "" {
+				secret.Namespace = namespace
+			}
+			// the API server merges stringData into data
+			for key, value := range secret.StringData {
+				if secret.Data == nil {
+					secret.Data = map[string][]byte{}
+				}
+				secret.Data[key] = []byte(value)
+			}
+			objects = append(objects, secret)
+		}
+	}
+	return fake.NewSimpleClientset(objects...), nil
+}
+
+// localRegistry replaces the registry with image configs read from files
+type localRegistry struct {
+	configs map[string]*imagev1.ImageConfig
+}
+
+// newLocalRegistry reads the images file, a YAML list of containerImageConfig, and the image=directory
+// OCI image layouts
+func newLocalRegistry(images string, layouts []string) (*localRegistry, error) {
+	r := &localRegistry{configs: map[string]*imagev1.ImageConfig{}}
+
+	if images != "" {
+		data, err := ioutil.ReadFile(images)
+		if err != nil {
+			return nil, err
+		}
+		var configs []containerImageConfig
+		if err := yaml.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("cannot read images %s: %s", images, err)
+		}
+		for _, config := range configs {
+			r.configs[config.Image] = &imagev1.ImageConfig{Entrypoint: config.Entrypoint, Cmd: config.Cmd}
+		}
+	}
+
+	for _, layout := range layouts {
+		parts := strings.SplitN(layout, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid OCI layout %q, expected image=directory", layout)
+		}
+		config, err := ociImageConfig(parts[1], parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot read OCI layout %s: %s", parts[1], err)
+		}
+		r.configs[parts[0]] = config
+	}
+
+	return r, nil
+}
+
+func (r *localRegistry) GetImageConfig(_ context.Context, logger log.FieldLogger, _ kubernetes.Interface, _ string, container *corev1.Container, _ *corev1.PodSpec) (*imagev1.ImageConfig, error) {
+	config, ok := r.configs[container.Image]
+	if !ok {
+		return nil, fmt.Errorf("image %s is not in the local images, add it with --images or --oci-layout", container.Image)
+	}
+	logger.Debugf("Using the local image config of %s", container.Image)
+	return config, nil
+}
+
+// ociImageConfig reads the config of an image from an OCI image layout directory: the manifest
+// whose reference name is the image or its tag, or the only one of the layout. Image indexes
+// are resolved to the manifest of the platform, or else the first one
+func ociImageConfig(dir, image string) (*imagev1.ImageConfig, error) {
+	var index imagev1.Index
+	if err := readOCIBlob(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	tag := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		tag = image[i+1:]
+	}
+
+	var descriptor *imagev1.Descriptor
+	for i, m := range index.Manifests {
+		if name := m.Annotations[imagev1.AnnotationRefName]; name == image || name == tag {
+			descriptor = &index.Manifests[i]
+			break
+		}
+	}
+	if descriptor == nil && len(index.Manifests) == 1 {
+		descriptor = &index.Manifests[0]
+	}
+	if descriptor == nil {
+		return nil, fmt.Errorf("no manifest is named %s or %s", image, tag)
+	}
+
+	// an image index is resolved to one of its manifests
+	for descriptor.MediaType == imagev1.MediaTypeImageIndex || descriptor.MediaType == "application/vnd.docker.distribution.manifest.list.v2+json" {
+		var nested imagev1.Index
+		if err := readOCIBlob(ociBlobPath(dir, *descriptor), &nested); err != nil {
+			return nil, err
+		}
+		if len(nested.Manifests) == 0 {
+			return nil, fmt.Errorf("image index %s has no manifests", descriptor.Digest)
+		}
+		descriptor = &nested.Manifests[0]
+		for i, m := range nested.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				descriptor = &nested.Manifests[i]
+				break
+			}
+		}
+	}
+
+	var manifest imagev1.Manifest
+	if err := readOCIBlob(ociBlobPath(dir, *descriptor), &manifest); err != nil {
+		return nil, err
+	}
+	var config imagev1.Image
+	if err := readOCIBlob(ociBlobPath(dir, manifest.Config), &config); err != nil {
+		return nil, err
+	}
+	return &config.Config, nil
+}
+
+func ociBlobPath(dir string, descriptor imagev1.Descriptor) string {
+	return filepath.Join(dir, "blobs", descriptor.Digest.Algorithm().String(), descriptor.Digest.Hex())
+}
+
+func readOCIBlob(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	goruntime "runtime"
+	"strings"
+	"testing"
+
+	cmp "github.com/google/go-cmp/cmp"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func Test_renderCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    vault.secret.manager/enabled: "true"
+    vault.secret.manager/service: https://vault:8200
+    vault.secret.manager/role: web
+    vault.secret.manager/path: secret/web
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+    envFrom:
+    - secretRef: {name: app-secret}
+---
+apiVersion: v1
+kind: Service
+metadata: {name: web}
+spec: {ports: [{port: 80}]}
+`
+	files := map[string]string{
+		"secrets.yaml": "apiVersion: v1\nkind: Secret\nmetadata: {name: app-secret}\nstringData: {API_KEY: \"vault:API_KEY\"}\n",
+		"images.yaml":  "- image: app:1.0\n  entrypoint: [/app]\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		exitCode int
+		stdout   []string
+		stderr   string
+	}{
+		{
+			name:     "object",
+			args:     []string{"--resources", dir + "/secrets.yaml", "--images", dir + "/images.yaml"},
+			exitCode: 0,
+			stdout:   []string{"- /secrets-consumer/secrets-consumer-env", "- /app", "secrets-consumer/status:", "---\napiVersion: v1\nkind: Service"},
+		},
+		{
+			name:     "patch",
+			args:     []string{"--output", "patch", "--resources", dir + "/secrets.yaml", "--images", dir + "/images.yaml"},
+			exitCode: 0,
+			stdout:   []string{`{"op":"add","path":"/spec/containers/0/command","value":["/secrets-consumer/secrets-consumer-env"]}`, "\n[]\n"},
+		},
+		{
+			name:     "missing image",
+			args:     []string{"--resources", dir + "/secrets.yaml"},
+			exitCode: 1,
+			stderr:   "document 1: Pod web: cannot detect the command of container app",
+		},
+		{
+			name:     "invalid output",
+			args:     []string{"--output", "json"},
+			exitCode: 2,
+			stderr:   `invalid output "json"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			exitCode := renderCommand(test.args, strings.NewReader(manifest), &stdout, &stderr)
+
+			if exitCode != test.exitCode {
+				t.Errorf("expected exit code %d, got %d: %s", test.exitCode, exitCode, stderr.String())
+			}
+			for _, want := range test.stdout {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected %q in the output:\n%s", want, stdout.String())
+				}
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Errorf("expected %q in the errors: %s", test.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+func Test_ociImageConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir+"/blobs/sha256", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// blobs are named after fake digests, ociImageConfig does not verify them
+	blobs := map[string]string{
+		"config-1": `{"config": {"Entrypoint": ["/app"], "Cmd": ["serve"]}}`,
+		"config-2": `{"config": {"Entrypoint": ["/worker"]}}`,
+		"app":      `{"schemaVersion": 2, "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:config-1"}}`,
+		"worker":   `{"schemaVersion": 2, "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:config-2"}}`,
+		"workers": `{"schemaVersion": 2, "manifests": [
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:app", "platform": {"os": "windows", "architecture": "amd64"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:worker", "platform": {"os": "linux", "architecture": "` + goruntime.GOARCH + `"}}]}`,
+	}
+	for name, content := range blobs {
+		if err := ioutil.WriteFile(dir+"/blobs/sha256/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := `{"schemaVersion": 2, "manifests": [
+		{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:app", "annotations": {"org.opencontainers.image.ref.name": "1.0"}},
+		{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:workers", "annotations": {"org.opencontainers.image.ref.name": "registry.example.com/worker:2.0"}}]}`
+	if err := ioutil.WriteFile(dir+"/index.json", []byte(index), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image   string
+		want    *imagev1.ImageConfig
+		wantErr bool
+	}{
+		{image: "registry.example.com/app:1.0", want: &imagev1.ImageConfig{Entrypoint: []string{"/app"}, Cmd: []string{"serve"}}},
+		{image: "registry.example.com/worker:2.0", want: &imagev1.ImageConfig{Entrypoint: []string{"/worker"}}},
+		{image: "registry.example.com/app:3.0", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ociImageConfig(dir, test.image)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.image, err)
+			continue
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("%s: %s", test.image, cmp.Diff(test.want, got))
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// annotationSchemaVersion is the version of the annotations used when AnnotationSchemaVersion is not set
+const annotationSchemaVersion = "v1"
+
+// annotationType is the type of the value of an annotation
+type annotationType int
+
+const (
+	stringAnnotation annotationType = iota
+	boolAnnotation
+	jsonAnnotation
+)
+
+// annotationSpec describes a supported annotation
+type annotationSpec struct {
+	typ annotationType
+	// containerScoped annotations can be set for a single container, see AnnotationContainerScope
+	containerScoped bool
+	// validate checks the value beyond its type, key is the unscoped annotation
+	validate func(key, value string) error
+}
+
+// annotationSchemas are the supported annotations by schema version
+var annotationSchemas = map[string]map[string]annotationSpec{
+	"v1": {
+		AnnotationAWSSecretManagerEnabled:         {typ: boolAnnotation, containerScoped: true},
+		AnnotationAWSSecretManagerRegion:          {typ: stringAnnotation, containerScoped: true},
+		AnnotationAWSSecretManagerRoleARN:         {typ: stringAnnotation, containerScoped: true},
+		AnnotationAWSSecretManagerSecretName:      {typ: stringAnnotation, containerScoped: true},
+		AnnotationAWSSecretManagerPreviousVersion: {typ: boolAnnotation, containerScoped: true},
+
+		AnnotationGCPSecretManagerEnabled:                        {typ: boolAnnotation, containerScoped: true},
+		AnnotationGCPSecretManagerProjectID:                      {typ: stringAnnotation, containerScoped: true},
+		AnnotationGCPSecretManagerSecretName:                     {typ: stringAnnotation, containerScoped: true},
+		AnnotationGCPSecretManagerSecretVersion:                  {typ: stringAnnotation, containerScoped: true},
+		AnnotationGCPSecretManagerGCPServiceAccountKeySecretName: {typ: stringAnnotation, containerScoped: true},
+
+		AnnotationVaultEnabled:                        {typ: boolAnnotation, containerScoped: true},
+		AnnotationVaultService:                        {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultAuthPath:                       {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultSecretPath:                     {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultRole:                           {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultGCPServiceAccountKeySecretName: {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultTLSSecret:                      {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultCACert:                         {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultK8sTokenPath:                   {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultUseSecretNamesAsKeys:           {typ: boolAnnotation, containerScoped: true},
+		AnnotationVaultSecretVersion:                  {typ: stringAnnotation, containerScoped: true},
+		AnnotationVaultMultiSecretPrefix + "N":        {typ: jsonAnnotation, containerScoped: true, validate: validateVaultSecretConfig},
+
+		AnnotationSchemaVersion:     {typ: stringAnnotation},
+		AnnotationImageConfigs:      {typ: jsonAnnotation, validate: validateImageConfigs},
+		AnnotationCommand:           {typ: jsonAnnotation},
+		AnnotationContainers:        {typ: stringAnnotation},
+		AnnotationExcludeContainers: {typ: stringAnnotation},
+		AnnotationExplicitSecrets:   {typ: boolAnnotation},
+		AnnotationWarning:           {typ: stringAnnotation},
+		AnnotationStatus:            {typ: jsonAnnotation},
+	},
+}
+
+// annotationPrefixes are the prefixes of the annotations owned by the webhook
+var annotationPrefixes = append(append([]string{}, backendAnnotationPrefixes...), "secrets-consumer/")
+
+func validateImageConfigs(_, value string) error {
+	_, err := parseImageConfigs(map[string]string{AnnotationImageConfigs: value})
+	return err
+}
+
+// schemaKey returns the schema key of an annotation, the secret-config-N annotations share a single key
+func schemaKey(key string) string {
+	if strings.HasPrefix(key, AnnotationVaultMultiSecretPrefix) {
+		return AnnotationVaultMultiSecretPrefix + "N"
+	}
+	return key
+}
+
+// unscopedKey returns the annotation a container scoped annotation overrides and the container name
+func unscopedKey(key string) (string, string, bool) {
+	for _, prefix := range backendAnnotationPrefixes {
+		if !strings.HasPrefix(key, prefix+AnnotationContainerScope) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, prefix+AnnotationContainerScope), ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", false
+		}
+		return prefix + parts[1], parts[0], true
+	}
+	return "", "", false
+}
+
+// validateAnnotations checks every annotation under the webhook prefixes against the schema and
+// returns all the problems at once: unknown keys, with the closest valid key, and invalid values
+func validateAnnotations(annotations map[string]string) error {
+	schema, err := annotationSchema(annotations)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		if !isOwnedAnnotation(key) {
+			continue
+		}
+
+		spec, lookup, ok := lookupAnnotation(schema, key)
+		if !ok {
+			errs = append(errs, unknownAnnotationError(key, schema))
+			continue
+		}
+
+		if err := spec.check(lookup, annotations[key]); err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %s", key, err))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// annotationSchema returns the schema of the AnnotationSchemaVersion of the annotations
+func annotationSchema(annotations map[string]string) (map[string]annotationSpec, error) {
+	version := annotationSchemaVersion
+	if v, ok := annotations[AnnotationSchemaVersion]; ok {
+		version = v
+	}
+	schema, ok := annotationSchemas[version]
+	if !ok {
+		return nil, fmt.Errorf("annotation %s: unsupported schema version %q, supported versions are %s", AnnotationSchemaVersion, version, strings.Join(schemaVersions(), ", "))
+	}
+	return schema, nil
+}
+
+// lookupAnnotation returns the spec of an annotation and the unscoped key it is checked as
+func lookupAnnotation(schema map[string]annotationSpec, key string) (annotationSpec, string, bool) {
+	lookup := key
+	if unscoped, _, ok := unscopedKey(key); ok {
+		lookup = unscoped
+	}
+	spec, ok := schema[schemaKey(lookup)]
+	if !ok || (lookup != key && !spec.containerScoped) {
+		return annotationSpec{}, "", false
+	}
+	return spec, lookup, true
+}
+
+func (spec annotationSpec) check(key, value string) error {
+	switch spec.typ {
+	case boolAnnotation:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid boolean %q, use \"true\" or \"false\"", value)
+		}
+	case jsonAnnotation:
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("invalid JSON %q", value)
+		}
+	}
+
+	if spec.validate != nil {
+		return spec.validate(key, value)
+	}
+	return nil
+}
+
+func schemaVersions() []string {
+	versions := make([]string, 0, len(annotationSchemas))
+	for version := range annotationSchemas {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// isOwnedAnnotation reports whether an annotation is under one of the webhook prefixes,
+// or a likely misspelling of one
+func isOwnedAnnotation(key string) bool {
+	for _, prefix := range annotationPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	slash := strings.Index(key, "/")
+	if slash < 0 {
+		return false
+	}
+	for _, prefix := range annotationPrefixes {
+		if levenshtein(key[:slash+1], prefix) <= 2 {
+			return true
+		}
+	}
+	return false
+}
+
+func unknownAnnotationError(key string, schema map[string]annotationSpec) error {
+	if suggestion := closestAnnotation(key, schema); suggestion != "" {
+		return fmt.Errorf("unknown annotation %s, did you mean %s?", key, suggestion)
+	}
+	return fmt.Errorf("unknown annotation %s", key)
+}
+
+// closestAnnotation returns the valid annotation with the smallest edit distance to key,
+// if it is close enough to be a misspelling
+func closestAnnotation(key string, schema map[string]annotationSpec) string {
+	scope := ""
+	lookup := key
+	if unscoped, name, ok := unscopedKey(key); ok {
+		lookup = unscoped
+		scope = name
+	}
+
+	best, bestDistance := "", -1
+	for candidate, spec := range schema {
+		if scope != "" && !spec.containerScoped {
+			continue
+		}
+		distance := levenshtein(lookup, candidate)
+		if bestDistance < 0 || distance < bestDistance || (distance == bestDistance && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+
+	// anything further away than a third of the key is not a misspelling
+	if bestDistance < 0 || bestDistance > len(lookup)/3 {
+		return ""
+	}
+
+	if scope != "" {
+		slash := strings.Index(best, "/")
+		return best[:slash+1] + AnnotationContainerScope + scope + "." + best[slash+1:]
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// vaultSecretConfig is a vault.secret.manager/secret-config-N annotation, read from the
+// canonical form handed to the wrapper with --secret-config
+type vaultSecretConfig struct {
+	Path                 string
+	Version              string
+	UseSecretNamesAsKeys bool
+}
+
+// UnmarshalJSON accepts the version as a number or a string, and use-secret-names-as-keys as a
+// bool or a string, the types the annotations use
+func (c *vaultSecretConfig) UnmarshalJSON(data []byte) error {
+	var raw canonicalVaultSecretConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw.Path, &c.Path); err != nil {
+		return fmt.Errorf("field \"path\" must be a string")
+	}
+	if len(raw.Version) > 0 {
+		version, err := parseJSONNumberOrString(raw.Version)
+		if err != nil {
+			return fmt.Errorf("field \"version\" %s", err)
+		}
+		c.Version = version
+	}
+	if len(raw.UseSecretNamesAsKeys) > 0 {
+		useSecretNamesAsKeys, err := parseJSONBoolOrString(raw.UseSecretNamesAsKeys)
+		if err != nil {
+			return fmt.Errorf("field \"use-secret-names-as-keys\" %s", err)
+		}
+		c.UseSecretNamesAsKeys = useSecretNamesAsKeys
+	}
+	return nil
+}
+
+// canonicalVaultSecretConfig is the form handed to the wrapper: the field names are lower cased
+// and order is dropped, the values keep the type they have in the annotation
+type canonicalVaultSecretConfig struct {
+	Path                 json.RawMessage `json:"path"`
+	Version              json.RawMessage `json:"version,omitempty"`
+	UseSecretNamesAsKeys json.RawMessage `json:"use-secret-names-as-keys,omitempty"`
+}
+
+// vaultSecretConfigFields are the fields of a secret config, matched case insensitively
+var vaultSecretConfigFields = []string{"path", "version", "use-secret-names-as-keys", "order"}
+
+// parseVaultSecretConfig parses the value of a secret config annotation. Numbered configs
+// (secret-config-3) are ordered by their number, named configs (secret-config-db) by their
+// order field. It returns the canonical config and its order
+func parseVaultSecretConfig(suffix, value string) (string, int, error) {
+	var config vaultSecretConfig
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return "", 0, fmt.Errorf("expected a JSON object like {\"path\": \"secret/data/app\"}: %s", err)
+	}
+
+	fields := map[string]json.RawMessage{}
+	for key, value := range raw {
+		field := strings.ToLower(key)
+		if !containsName(vaultSecretConfigFields, field) {
+			return "", 0, fmt.Errorf("unknown field %q, valid fields are %s", key, strings.Join(vaultSecretConfigFields, ", "))
+		}
+		if _, ok := fields[field]; ok {
+			return "", 0, fmt.Errorf("field %q is set more than once", field)
+		}
+		fields[field] = value
+	}
+
+	var errs []error
+
+	if err := json.Unmarshal(fields["path"], &config.Path); err != nil || config.Path == "" {
+		errs = append(errs, fmt.Errorf("field \"path\" must be a non empty string"))
+	}
+
+	if version, ok := fields["version"]; ok {
+		var err error
+		if config.Version, err = parseJSONNumberOrString(version); err != nil {
+			errs = append(errs, fmt.Errorf("field \"version\" %s", err))
+		} else if n, err := strconv.Atoi(config.Version); err != nil || n < 0 {
+			// 0 is the latest version for Vault
+			errs = append(errs, fmt.Errorf("field \"version\" must be a non-negative number, got %q", config.Version))
+		}
+	}
+
+	if useSecretNamesAsKeys, ok := fields["use-secret-names-as-keys"]; ok {
+		value, err := parseJSONBoolOrString(useSecretNamesAsKeys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field \"use-secret-names-as-keys\" %s", err))
+		}
+		config.UseSecretNamesAsKeys = value
+	}
+
+	order, numbered := 0, false
+	if n, err := strconv.Atoi(suffix); err == nil && n >= 0 {
+		order, numbered = n, true
+	} else if msgs := validation.IsDNS1123Label(suffix); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("the suffix %q must be a number or a name: %s", suffix, strings.Join(msgs, ", ")))
+	}
+
+	if rawOrder, ok := fields["order"]; ok {
+		if numbered {
+			errs = append(errs, fmt.Errorf("field \"order\" is only allowed on named configs, numbered configs are ordered by their number"))
+		} else if err := json.Unmarshal(rawOrder, &order); err != nil {
+			errs = append(errs, fmt.Errorf("field \"order\" must be a number"))
+		}
+	} else if !numbered {
+		errs = append(errs, fmt.Errorf("field \"order\" is required on named configs"))
+	}
+
+	if len(errs) > 0 {
+		return "", 0, utilerrors.NewAggregate(errs)
+	}
+
+	canonical, err := json.Marshal(canonicalVaultSecretConfig{
+		Path:                 fields["path"],
+		Version:              fields["version"],
+		UseSecretNamesAsKeys: fields["use-secret-names-as-keys"],
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return string(canonical), order, nil
+}
+
+func parseJSONNumberOrString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String(), nil
+	}
+	return "", fmt.Errorf("must be a number or a string, got %s", raw)
+}
+
+func parseJSONBoolOrString(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("must be true or false, got %s", raw)
+}
+
+// parseVaultSecretConfigs returns the canonical form of the secret config annotations in order,
+// along with the errors of the invalid ones
+func parseVaultSecretConfigs(annotations map[string]string) ([]string, error) {
+	type entry struct {
+		suffix    string
+		order     int
+		canonical string
+	}
+
+	var entries []entry
+	var errs []error
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, AnnotationVaultMultiSecretPrefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(key, AnnotationVaultMultiSecretPrefix)
+
+		canonical, order, err := parseVaultSecretConfig(suffix, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %s", key, err))
+			continue
+		}
+		entries = append(entries, entry{suffix: suffix, order: order, canonical: canonical})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].order != entries[j].order {
+			return entries[i].order < entries[j].order
+		}
+		return entries[i].suffix < entries[j].suffix
+	})
+
+	configs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		configs = append(configs, e.canonical)
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return configs, utilerrors.NewAggregate(errs)
+}
+
+// validateVaultSecretConfig is the schema validation of a secret config annotation
+func validateVaultSecretConfig(key, value string) error {
+	_, _, err := parseVaultSecretConfig(strings.TrimPrefix(key, AnnotationVaultMultiSecretPrefix), value)
+	return err
+}
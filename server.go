@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// newHTTPServer returns a server with timeouts, so that slow or stuck clients cannot hold connections forever.
+// The write timeout must be above the longest admission timeout the API server allows (30s)
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: viper.GetDuration("server_read_header_timeout"),
+		ReadTimeout:       viper.GetDuration("server_read_timeout"),
+		WriteTimeout:      viper.GetDuration("server_write_timeout"),
+		IdleTimeout:       viper.GetDuration("server_idle_timeout"),
+		MaxHeaderBytes:    viper.GetInt("server_max_header_bytes"),
+	}
+}
+
+// handleTelemetry serves the metrics and the log level on mux, the mux of telemetry_listen_address
+// or, when it is not set, of the webhook itself so that the log level can always be changed
+func handleTelemetry(mux *http.ServeMux, logger *log.Logger) {
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/loglevel", logLevelHandler(logger))
+}
+
+// admissionHandler wraps the handler of an admission webhook with the client certificate
+// check, the request body limit and the admission deadline
+func admissionHandler(next http.Handler) http.Handler {
+	return withClientCert(withBodyLimit(withAdmissionDeadline(next)))
+}
+
+// withBodyLimit rejects the requests larger than server_max_body_bytes
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := viper.GetInt64("server_max_body_bytes")
+		if r.ContentLength > limit {
+			http.Error(w, fmt.Sprintf("request body larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withClientCert rejects the requests without a client certificate when tls_client_ca_file is set.
+// The TLS handshake only verifies the certificates that are sent, so that the kubelet probes and
+// Prometheus do not need one. With tls_client_allowed_names the certificate must also be issued
+// to one of the names, as its common name or a DNS name
+func withClientCert(next http.Handler) http.Handler {
+	if viper.GetString("tls_client_ca_file") == "" {
+		return next
+	}
+	allowed := parseContainerNames(viper.GetString("tls_client_allowed_names"))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "a client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		if len(allowed) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+			matched := false
+			for _, name := range names {
+				if containsName(allowed, name) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				http.Error(w, fmt.Sprintf("client certificate %s is not allowed", cert.Subject.CommonName), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newTLSConfig returns the TLS configuration of the webhook server, verifying the client
+// certificates signed by tls_client_ca_file
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	caFile := viper.GetString("tls_client_ca_file")
+	if caFile == "" {
+		return config, nil
+	}
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the client CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificate found in the client CA %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// shutdownOnSignal waits for a signal or for a server to fail. On a signal it fails the readiness
+// probe, waits shutdown_delay for the pod to be removed from the service endpoints, and lets the
+// in-flight requests complete within shutdown_timeout. The audit records of the last admissions
+// are then flushed within what remains of shutdown_timeout
+func shutdownOnSignal(signals <-chan os.Signal, errCh <-chan error, ready *readiness, audit *auditor, logger log.FieldLogger, servers ...*http.Server) error {
+	select {
+	case err := <-errCh:
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown_timeout"))
+		defer cancel()
+		closeAuditor(ctx, audit, logger)
+		return err
+	case sig := <-signals:
+		logger.Infof("Received %s, shutting down", sig)
+	}
+
+	ready.drain()
+	time.Sleep(viper.GetDuration("shutdown_delay"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown_timeout"))
+	defer cancel()
+
+	var shutdownErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			shutdownErr = fmt.Errorf("cannot drain the requests to %s: %s", server.Addr, err)
+		}
+	}
+	if shutdownErr == nil {
+		logger.Infof("All requests drained")
+	}
+	closeAuditor(ctx, audit, logger)
+	return shutdownErr
+}
+
+// closeAuditor flushes the audit records still waiting to be written, until ctx is done
+func closeAuditor(ctx context.Context, audit *auditor, logger log.FieldLogger) {
+	if audit == nil {
+		return
+	}
+	if err := audit.close(ctx); err != nil {
+		logger.Errorf("Lost audit records on shutdown: %s", err)
+	}
+}
@@ -16,4 +16,12 @@ const (
 
 	// VaultTLSVolumeName name of the volume for the vault TLS certs and keys
 	VaultTLSVolumeName = "vault-tls"
+
+	// ResolveImageEnvVar the image whose entrypoint the wrapper resolves when the container starts, set on
+	// the containers admitted with the admit-with-warning policy as their command could not be detected
+	ResolveImageEnvVar = "SECRETS_CONSUMER_RESOLVE_IMAGE"
+
+	// ExplicitSecretKeysEnvVar lists the only secret manager keys the wrapper exposes to the process,
+	// comma separated, set on the containers when explicit secrets are enabled
+	ExplicitSecretKeysEnvVar = "SECRETS_CONSUMER_EXPLICIT_KEYS"
 )
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/innovia/secrets-consumer-webhook/version"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// secretsConsumerEnvPath the wrapper the mutated containers run their command with
+	secretsConsumerEnvPath = "/secrets-consumer/secrets-consumer-env"
+
+	// secretsConsumerEnvVolume the in-memory volume the wrapper binary is copied into
+	secretsConsumerEnvVolume = "secrets-consumer-env"
+
+	// copySecretsConsumerEnvContainer the init container copying the wrapper binary into the volume
+	copySecretsConsumerEnvContainer = "copy-secrets-consumer-env"
+)
+
+// injectionStatus is recorded in the AnnotationStatus annotation of the mutated pods
+type injectionStatus struct {
+	Version        string   `json:"version"`
+	Backends       []string `json:"backends"`
+	InitContainers []string `json:"initContainers,omitempty"`
+	Containers     []string `json:"containers,omitempty"`
+}
+
+// isWrapped reports whether a container already runs its command with the wrapper
+func isWrapped(container corev1.Container) bool {
+	return len(container.Command) > 0 && container.Command[0] == secretsConsumerEnvPath
+}
+
+// isPodMutated reports whether the webhook already mutated the pod, e.g. on a reinvocation.
+// The annotation alone is not trusted, it is copied along with the rest of the metadata
+func isPodMutated(pod *corev1.Pod) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == copySecretsConsumerEnvContainer {
+			return true
+		}
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == secretsConsumerEnvVolume {
+			return true
+		}
+	}
+	return false
+}
+
+func wrappedContainers(containers []corev1.Container) []string {
+	var names []string
+	for _, c := range containers {
+		if isWrapped(c) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// newInjectionStatus describes the secrets injection of a mutated pod, the backends are the ones
+// enabled for at least one of the wrapped containers
+func newInjectionStatus(pod *corev1.Pod, secretManagerConfig secretManagerConfig) injectionStatus {
+	status := injectionStatus{
+		Version:        version.GetVersion(),
+		Backends:       []string{},
+		InitContainers: wrappedContainers(pod.Spec.InitContainers),
+		Containers:     wrappedContainers(pod.Spec.Containers),
+	}
+
+	backends := map[string]bool{}
+	for _, name := range append(append([]string{}, status.InitContainers...), status.Containers...) {
+		cfg := secretManagerConfig.forContainer(name)
+		backends["aws"] = backends["aws"] || cfg.aws.config.enabled
+		backends["gcp"] = backends["gcp"] || cfg.gcp.config.enabled
+		backends["vault"] = backends["vault"] || cfg.vault.config.enabled
+	}
+	for _, backend := range []string{"aws", "gcp", "vault"} {
+		if backends[backend] {
+			status.Backends = append(status.Backends, backend)
+		}
+	}
+	return status
+}
+
+func (s injectionStatus) String() string {
+	value, _ := json.Marshal(s)
+	return string(value)
+}
+
+func hasImagePullSecret(secrets []corev1.LocalObjectReference, name string) bool {
+	for _, s := range secrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/innovia/secrets-consumer-webhook/version"
+	"github.com/slok/kubewebhook/pkg/webhook"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tracerName = "github.com/innovia/secrets-consumer-webhook"
+
+	// attributeAdmissionUID is set on every span of an admission, to find the trace of a pod creation
+	attributeAdmissionUID = attribute.Key("admission.uid")
+)
+
+// startSpan starts a span of the global tracer provider, which drops the spans unless
+// tracing_otlp_endpoint is set
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		attrs = append(attrs, attributeAdmissionUID.String(string(ar.UID)))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed with err
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// admissionSpans are the spans of the steps kubewebhook runs around the mutator: the decoding
+// of the object before it and the JSON patch generation after it
+type admissionSpans struct {
+	ctx    context.Context
+	decode trace.Span
+	patch  trace.Span
+}
+
+type admissionSpansKey struct{}
+
+// tracedWebhook traces the admission reviews of a mutating webhook
+type tracedWebhook struct {
+	webhook webhook.Webhook
+}
+
+func (w *tracedWebhook) Review(ctx context.Context, ar *admissionv1beta1.AdmissionReview) *admissionv1beta1.AdmissionResponse {
+	ctx, span := startSpan(ctx, "admission",
+		attribute.String("k8s.namespace.name", ar.Request.Namespace),
+		attribute.String("k8s.kind", ar.Request.Kind.Kind),
+		attribute.String("admission.operation", string(ar.Request.Operation)),
+	)
+	spans := &admissionSpans{ctx: ctx}
+	_, spans.decode = startSpan(ctx, "admission.decode")
+
+	resp := w.webhook.Review(context.WithValue(ctx, admissionSpansKey{}, spans), ar)
+
+	var err error
+	if !resp.Allowed && resp.Result != nil {
+		err = fmt.Errorf("%s", resp.Result.Message)
+	}
+	// the mutator was not called when the object could not be decoded
+	if spans.decode != nil {
+		endSpan(spans.decode, err)
+	}
+	if spans.patch != nil {
+		endSpan(spans.patch, err)
+	}
+	endSpan(span, err)
+	return resp
+}
+
+// tracedMutator ends the decode span when the mutator is called and starts the patch span when it returns
+func tracedMutator(mutator mutating.Mutator) mutating.Mutator {
+	return mutating.MutatorFunc(func(ctx context.Context, obj metav1.Object) (bool, error) {
+		spans, _ := ctx.Value(admissionSpansKey{}).(*admissionSpans)
+		if spans == nil {
+			return mutator.Mutate(ctx, obj)
+		}
+		spans.decode.End()
+		spans.decode = nil
+
+		stop, err := mutator.Mutate(ctx, obj)
+		if err == nil {
+			_, spans.patch = startSpan(spans.ctx, "admission.patch")
+		}
+		return stop, err
+	})
+}
+
+// newTracerProvider exports the spans to the OTLP/HTTP endpoint tracing_otlp_endpoint, sampling
+// tracing_sample_ratio of the admissions
+func newTracerProvider() (*sdktrace.TracerProvider, error) {
+	exporter, err := newOTLPExporter(viper.GetString("tracing_otlp_endpoint"))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing_sample_ratio")))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", viper.GetString("tracing_service_name")),
+			attribute.String("service.version", version.GetVersion()),
+		)),
+	), nil
+}
+
+// newOTLPExporter returns the OTLP/HTTP exporter of an endpoint like http://otel-collector:4318,
+// sending the spans to its /v1/traces path with the tracing_otlp_headers
+func newOTLPExporter(endpoint string) (*otlptrace.Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, it must start with http:// or https://", endpoint)
+	}
+
+	headers := map[string]string{}
+	for _, header := range parseContainerNames(viper.GetString("tracing_otlp_headers")) {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected name=value", header)
+		}
+		headers[parts[0]] = parts[1]
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithTimeout(viper.GetDuration("tracing_otlp_timeout")),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
@@ -4,17 +4,31 @@ import (
 	"github.com/innovia/secrets-consumer-webhook/registry"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 type secretManagerConfig struct {
 	aws
 	gcp
 	vault
-	explicitSecrets bool // only get secrets that match the prefix `secret:`
+	explicitSecrets   bool                            // only expose the keys referenced by `vault:` and `secret:` env values
+	imageConfigs      map[string]containerImageConfig // container entrypoints resolved on the pod template
+	unresolved        map[string]string               // containers admitted without a detected command, the wrapper resolves it
+	commandHint       []string                        // command of every container without one
+	commandHints      map[string][]string             // command of specific containers without one
+	commandHintErr    error                           // invalid AnnotationCommand, rejected
+	annotationErrs    []error                         // invalid boolean annotations, rejected
+	containers        []string                        // only inject secrets into these containers
+	excludeContainers []string                        // never inject secrets into these containers
+	containerConfigs  map[string]secretManagerConfig  // backends of the containers with container scoped annotations
 }
 
 type mutatingWebhook struct {
-	k8sClient kubernetes.Interface
-	registry  registry.ImageRegistry
-	logger    log.FieldLogger
+	k8sClient  kubernetes.Interface
+	registry   registry.ImageRegistry
+	logger     log.FieldLogger
+	references *referenceListers
+	preflight  *preflightChecker
+	recorder   record.EventRecorder
+	audit      *auditor
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// validatePodConfig runs the admission checks of the pods on their annotations and spec,
+// it returns all the problems at once
+func validatePodConfig(annotations map[string]string, smCfg secretManagerConfig, podSpec *corev1.PodSpec) error {
+	var errs []error
+	reported := map[string]bool{}
+	if agg, ok := validateAnnotations(annotations).(utilerrors.Aggregate); ok {
+		for _, err := range agg.Errors() {
+			errs = append(errs, err)
+			reported[err.Error()] = true
+		}
+	}
+	// the invalid booleans are read as false, they are reported even when that disables every backend
+	if smCfg.isEnabled() || len(smCfg.annotationErrs) > 0 {
+		if agg, ok := smCfg.validatePod(podSpec).(utilerrors.Aggregate); ok {
+			for _, err := range agg.Errors() {
+				if !reported[err.Error()] {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// WorkloadValidator rejects workload controllers whose pod template the pod admission would reject,
+// so that the errors surface on apply rather than as FailedCreate events of the controller
+// return a stop boolean to stop executing the chain, the validation result and also an error.
+func (mw *mutatingWebhook) WorkloadValidator(ctx context.Context, obj metav1.Object) (bool, validating.ValidatorResult, error) {
+	mw = mw.forRequest(ctx, obj)
+
+	template := podTemplateSpec(obj)
+	if template == nil {
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	smCfg := mw.parseSecretManagerConfig(&template.ObjectMeta)
+	if err := validatePodConfig(template.Annotations, smCfg, &template.Spec); err != nil {
+		mw.logger.Infof("Rejecting the pod template: %s", err)
+		return true, validating.ValidatorResult{Valid: false, Message: "invalid pod template: " + err.Error()}, nil
+	}
+
+	return false, validating.ValidatorResult{Valid: true}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/innovia/secrets-consumer-webhook/registry"
+	imagev1 "github.com/opencontainers/image-spec/specs-go/v1"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// containerImageConfig is the resolved entrypoint of a container, stored on pod templates
+// so that the pods created from them don't need a registry lookup
+type containerImageConfig struct {
+	Image      string   `json:"image"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+}
+
+// imageConfigFor returns the known image config of a container, if it was resolved for the same image
+func imageConfigFor(imageConfigs map[string]containerImageConfig, container corev1.Container) *imagev1.ImageConfig {
+	known, ok := imageConfigs[container.Name]
+	if !ok || known.Image != container.Image {
+		return nil
+	}
+	return &imagev1.ImageConfig{Entrypoint: known.Entrypoint, Cmd: known.Cmd}
+}
+
+func parseImageConfigs(annotations map[string]string) (map[string]containerImageConfig, error) {
+	value, ok := annotations[AnnotationImageConfigs]
+	if !ok {
+		return nil, nil
+	}
+
+	var imageConfigs map[string]containerImageConfig
+	if err := json.Unmarshal([]byte(value), &imageConfigs); err != nil {
+		return nil, err
+	}
+	return imageConfigs, nil
+}
+
+// podTemplateSpec returns the pod template of the supported workload controllers
+func podTemplateSpec(obj metav1.Object) *corev1.PodTemplateSpec {
+	switch v := obj.(type) {
+	case *appsv1.Deployment:
+		return &v.Spec.Template
+	case *appsv1.StatefulSet:
+		return &v.Spec.Template
+	case *appsv1.DaemonSet:
+		return &v.Spec.Template
+	case *batchv1.Job:
+		return &v.Spec.Template
+	case *batchv1beta1.CronJob:
+		return &v.Spec.JobTemplate.Spec.Template
+	default:
+		return nil
+	}
+}
+
+// mutatePodTemplate resolves the entrypoint of the containers without an explicit command
+// and stores it in the AnnotationImageConfigs annotation of the template
+func (mw *mutatingWebhook) mutatePodTemplate(ctx context.Context, template *corev1.PodTemplateSpec, ns string) error {
+	smCfg := mw.parseSecretManagerConfig(&template.ObjectMeta)
+	if !smCfg.isEnabled() {
+		return nil
+	}
+
+	var containers []corev1.Container
+	for _, c := range append(append([]corev1.Container{}, template.Spec.InitContainers...), template.Spec.Containers...) {
+		// images that may change between pulls are looked up for every pod
+		if len(c.Command) == 0 && commandHint(smCfg, c) == nil && isContainerSelected(smCfg, c) && registry.IsAllowedToCache(&c) {
+			containers = append(containers, c)
+		}
+	}
+
+	// entries carried over from a previous version of the template are only kept for the same
+	// container and image, and while the registry cannot resolve them again
+	known := smCfg.imageConfigs
+	imageConfigs := map[string]containerImageConfig{}
+	for _, c := range containers {
+		if imageConfigFor(known, c) != nil {
+			imageConfigs[c.Name] = known[c.Name]
+		}
+	}
+
+	if len(containers) > 0 {
+		smCfg.imageConfigs = nil
+		resolved, errs := mw.getImageConfigs(ctx, containers, &template.Spec, ns, smCfg)
+		for i, c := range containers {
+			if errs[i] != nil {
+				// the pods will use the previous entry or look it up on admission
+				mw.logger.Warnf("Cannot resolve the pod template entrypoint: %s", errs[i])
+				continue
+			}
+			imageConfigs[c.Name] = containerImageConfig{
+				Image:      c.Image,
+				Entrypoint: resolved[i].Entrypoint,
+				Cmd:        resolved[i].Cmd,
+			}
+		}
+	}
+
+	if len(imageConfigs) == 0 {
+		delete(template.Annotations, AnnotationImageConfigs)
+		return nil
+	}
+
+	value, err := json.Marshal(imageConfigs)
+	if err != nil {
+		return err
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[AnnotationImageConfigs] = string(value)
+	mw.logger.Debugf("Resolved pod template entrypoints: %s", value)
+
+	return nil
+}
+
+// WorkloadMutator stores the container entrypoints on the pod template of workload controllers
+// return a stop boolean to stop executing the chain and also an error.
+func (mw *mutatingWebhook) WorkloadMutator(ctx context.Context, obj metav1.Object) (bool, error) {
+	template := podTemplateSpec(obj)
+	if template == nil {
+		return false, nil
+	}
+
+	return false, mw.forRequest(ctx, obj).mutatePodTemplate(ctx, template, whcontext.GetAdmissionRequest(ctx).Namespace)
+}